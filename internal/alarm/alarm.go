@@ -0,0 +1,99 @@
+package alarm
+
+import (
+	"encoding/xml"
+	"strconv"
+	"time"
+
+	"github.com/jart/gosip/sip"
+	"github.com/jart/gosip/util"
+	"github.com/lzh2nix/gb28181Simulator/internal/config"
+	"github.com/lzh2nix/gb28181Simulator/internal/transport"
+	"github.com/lzh2nix/gb28181Simulator/internal/version"
+	"github.com/qiniu/x/xlog"
+)
+
+// Alarm is an alarm event raised by a device or one of its channels
+// (GB/T 28181-2016 §9.4). Priority is 1 to 4, Method 1 telephone, 2 device,
+// 3 sms, 4 gps, 5 video, 6 device fault, 7 other.
+type Alarm struct {
+	DeviceID    string `json:"deviceID"`
+	Priority    int    `json:"priority"`
+	Method      int    `json:"method"`
+	Type        int    `json:"type"`
+	Description string `json:"description"`
+}
+
+type alarmInfo struct {
+	AlarmType int `xml:"AlarmType"`
+}
+
+type alarmNotify struct {
+	XMLName          xml.Name   `xml:"Notify"`
+	CmdType          string     `xml:"CmdType"`
+	SN               string     `xml:"SN"`
+	DeviceID         string     `xml:"DeviceID"`
+	AlarmPriority    int        `xml:"AlarmPriority"`
+	AlarmMethod      int        `xml:"AlarmMethod"`
+	AlarmTime        string     `xml:"AlarmTime"`
+	AlarmDescription string     `xml:"AlarmDescription,omitempty"`
+	Info             *alarmInfo `xml:"Info,omitempty"`
+}
+
+func (n *alarmNotify) ContentType() string {
+	return "Application/MANSCDP+xml"
+}
+func (n *alarmNotify) Data() []byte {
+	data, _ := xml.MarshalIndent(n, "  ", "    ")
+	return []byte(xml.Header + string(data))
+}
+
+// Send notifies the platform of a, an empty DeviceID means the device itself.
+func Send(xlog *xlog.Logger, tr *transport.Transport, cfg *config.Config, a Alarm) {
+	if a.DeviceID == "" {
+		a.DeviceID = cfg.GBID
+	}
+	if a.Priority == 0 {
+		a.Priority = 1
+	}
+	if a.Method == 0 {
+		a.Method = 2
+	}
+	payload := &alarmNotify{
+		CmdType:          "Alarm",
+		SN:               strconv.Itoa(util.GenerateCSeq()),
+		DeviceID:         a.DeviceID,
+		AlarmPriority:    a.Priority,
+		AlarmMethod:      a.Method,
+		AlarmTime:        time.Now().Format("2006-01-02T15:04:05"),
+		AlarmDescription: a.Description,
+	}
+	if a.Type != 0 {
+		payload.Info = &alarmInfo{AlarmType: a.Type}
+	}
+	localHost, localPort := tr.ContactAddr()
+	req := &sip.Msg{
+		CSeq:       util.GenerateCSeq(),
+		CallID:     util.GenerateCallID(),
+		Method:     sip.MethodMessage,
+		CSeqMethod: sip.MethodMessage,
+		UserAgent:  version.Version(),
+		Request:    &sip.URI{Scheme: "sip", User: cfg.ServerID, Host: cfg.Realm},
+		Via: &sip.Via{
+			Version:   "2.0",
+			Protocol:  "SIP",
+			Transport: tr.Proto(),
+			Host:      transport.ViaHost(localHost),
+			Port:      uint16(localPort),
+			Param:     &sip.Param{Name: "branch", Value: util.GenerateBranch(), Next: &sip.Param{Name: "rport"}},
+		},
+		From: &sip.Addr{
+			Uri:   &sip.URI{User: cfg.GBID, Host: cfg.Realm},
+			Param: &sip.Param{Name: "tag", Value: util.GenerateTag()},
+		},
+		To:      &sip.Addr{Uri: &sip.URI{User: cfg.ServerID, Host: cfg.Realm}},
+		Payload: payload,
+	}
+	xlog.Infof("[C->S] alarm %s priority %d method %d", a.DeviceID, a.Priority, a.Method)
+	tr.Send <- req
+}
@@ -0,0 +1,185 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/lzh2nix/gb28181Simulator/internal/alarm"
+	"github.com/lzh2nix/gb28181Simulator/internal/catalog"
+	"github.com/lzh2nix/gb28181Simulator/internal/invite"
+	"github.com/lzh2nix/gb28181Simulator/internal/useragent"
+	"github.com/qiniu/x/xlog"
+)
+
+// Server is the local control api of a running simulator:
+//
+//	GET  /devices                                   list devices
+//	GET  /devices/{id}                              one device
+//	POST /devices/{id}/register                     register now
+//	POST /devices/{id}/unregister                   unregister and stay so
+//	POST /devices/{id}/channels/{ch}/online         channel ON + catalog notify
+//	POST /devices/{id}/channels/{ch}/offline        channel OFF + catalog notify
+//	POST /devices/{id}/channels/{ch}/media          {"file": "..."}
+//	POST /devices/{id}/alarm                        alarm.Alarm as json
+//	POST /devices/{id}/sessions/{callId}/bye        hang up from the device
+type Server struct {
+	xlog *xlog.Logger
+
+	mu       sync.RWMutex
+	services map[string]Device
+}
+
+// Device is what the api drives, implemented by *useragent.Service.
+type Device interface {
+	ID() string
+	Status() useragent.DeviceStatus
+	Register()
+	Unregister()
+	Alarm(a alarm.Alarm)
+	SetChannelStatus(chid string, online bool) error
+	SetMediaSource(chid, file string) error
+	Hangup(callID string) error
+}
+
+func NewServer(xlog *xlog.Logger) *Server {
+	return &Server{xlog: xlog, services: make(map[string]Device)}
+}
+
+// Add makes a device controllable through the api.
+func (s *Server) Add(srv Device) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.services[srv.ID()] = srv
+}
+
+// ListenAndServe serves the api on addr in the background.
+func (s *Server) ListenAndServe(addr string) {
+	go func() {
+		s.xlog.Infof("serve control api on %s", addr)
+		if err := http.ListenAndServe(addr, s); err != nil {
+			s.xlog.Errorf("serve control api failed, err = %v", err)
+		}
+	}()
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	code := http.StatusBadRequest
+	switch {
+	case errors.Is(err, catalog.ErrUnknownChannel), errors.Is(err, invite.ErrNoSession):
+		code = http.StatusNotFound
+	case errors.Is(err, os.ErrNotExist):
+		code = http.StatusUnprocessableEntity
+	}
+	writeJSON(w, code, apiError{err.Error()})
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if parts[0] != "devices" {
+		http.NotFound(w, r)
+		return
+	}
+	if len(parts) == 1 {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, http.StatusOK, s.list())
+		return
+	}
+	s.mu.RLock()
+	srv, ok := s.services[parts[1]]
+	s.mu.RUnlock()
+	if !ok {
+		writeJSON(w, http.StatusNotFound, apiError{"unknown device"})
+		return
+	}
+	if len(parts) == 2 {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, http.StatusOK, srv.Status())
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s.action(w, r, srv, parts[2:])
+}
+
+func (s *Server) list() []useragent.DeviceStatus {
+	s.mu.RLock()
+	services := make([]Device, 0, len(s.services))
+	for _, srv := range s.services {
+		services = append(services, srv)
+	}
+	s.mu.RUnlock()
+	sort.Slice(services, func(i, j int) bool { return services[i].ID() < services[j].ID() })
+	list := make([]useragent.DeviceStatus, 0, len(services))
+	for _, srv := range services {
+		list = append(list, srv.Status())
+	}
+	return list
+}
+
+func (s *Server) action(w http.ResponseWriter, r *http.Request, srv Device, path []string) {
+	var err error
+	switch {
+	case len(path) == 1 && path[0] == "register":
+		srv.Register()
+	case len(path) == 1 && path[0] == "unregister":
+		srv.Unregister()
+	case len(path) == 1 && path[0] == "alarm":
+		var a alarm.Alarm
+		if err = decodeBody(r, &a); err == nil {
+			srv.Alarm(a)
+		}
+	case len(path) == 3 && path[0] == "channels" && (path[2] == "online" || path[2] == "offline"):
+		err = srv.SetChannelStatus(path[1], path[2] == "online")
+	case len(path) == 3 && path[0] == "channels" && path[2] == "media":
+		var body struct {
+			File string `json:"file"`
+		}
+		if err = decodeBody(r, &body); err == nil {
+			err = srv.SetMediaSource(path[1], body.File)
+		}
+	case len(path) == 3 && path[0] == "sessions" && path[2] == "bye":
+		err = srv.Hangup(path[1])
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	s.xlog.Infof("api %s %s", r.Method, r.URL.Path)
+	writeJSON(w, http.StatusOK, srv.Status())
+}
+
+// decodeBody accepts an empty body as the zero value.
+func decodeBody(r *http.Request, v interface{}) error {
+	err := json.NewDecoder(r.Body).Decode(v)
+	if errors.Is(err, io.EOF) {
+		return nil
+	}
+	return err
+}
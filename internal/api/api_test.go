@@ -0,0 +1,164 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/lzh2nix/gb28181Simulator/internal/alarm"
+	"github.com/lzh2nix/gb28181Simulator/internal/catalog"
+	"github.com/lzh2nix/gb28181Simulator/internal/invite"
+	"github.com/lzh2nix/gb28181Simulator/internal/useragent"
+	"github.com/qiniu/x/xlog"
+)
+
+const (
+	channel = "34020000001320000001"
+	callID  = "call-1"
+)
+
+// stubDevice has one channel and one session and records what it was asked
+// to do.
+type stubDevice struct {
+	id    string
+	calls []string
+}
+
+func (d *stubDevice) ID() string { return d.id }
+
+func (d *stubDevice) Status() useragent.DeviceStatus {
+	return useragent.DeviceStatus{ID: d.id, Channels: []useragent.ChannelStatus{{ID: channel, Status: "ON"}}}
+}
+
+func (d *stubDevice) Register()   { d.calls = append(d.calls, "register") }
+func (d *stubDevice) Unregister() { d.calls = append(d.calls, "unregister") }
+
+func (d *stubDevice) Alarm(a alarm.Alarm) {
+	d.calls = append(d.calls, fmt.Sprintf("alarm %d", a.Type))
+}
+
+func (d *stubDevice) SetChannelStatus(chid string, online bool) error {
+	if chid != channel {
+		return catalog.ErrUnknownChannel
+	}
+	d.calls = append(d.calls, fmt.Sprintf("online %v", online))
+	return nil
+}
+
+func (d *stubDevice) SetMediaSource(chid, file string) error {
+	if chid != channel {
+		return catalog.ErrUnknownChannel
+	}
+	if _, err := os.Stat(file); err != nil {
+		return err
+	}
+	d.calls = append(d.calls, "media "+file)
+	return nil
+}
+
+func (d *stubDevice) Hangup(id string) error {
+	if id != callID {
+		return invite.ErrNoSession
+	}
+	d.calls = append(d.calls, "bye")
+	return nil
+}
+
+func TestServer(t *testing.T) {
+	media, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		method, path, body string
+		code               int
+		call               string
+	}{
+		{"GET", "/devices", "", http.StatusOK, ""},
+		{"POST", "/devices", "", http.StatusMethodNotAllowed, ""},
+		{"GET", "/other", "", http.StatusNotFound, ""},
+		{"GET", "/devices/dev1", "", http.StatusOK, ""},
+		{"DELETE", "/devices/dev1", "", http.StatusMethodNotAllowed, ""},
+		{"GET", "/devices/nodev", "", http.StatusNotFound, ""},
+		{"POST", "/devices/nodev/register", "", http.StatusNotFound, ""},
+		{"GET", "/devices/dev1/register", "", http.StatusMethodNotAllowed, ""},
+		{"POST", "/devices/dev1/register", "", http.StatusOK, "register"},
+		{"POST", "/devices/dev1/unregister", "", http.StatusOK, "unregister"},
+		{"POST", "/devices/dev1/reboot", "", http.StatusNotFound, ""},
+		{"POST", "/devices/dev1/alarm", `{"type": 2}`, http.StatusOK, "alarm 2"},
+		{"POST", "/devices/dev1/alarm", "", http.StatusOK, "alarm 0"},
+		{"POST", "/devices/dev1/alarm", `{"type": `, http.StatusBadRequest, ""},
+		{"POST", "/devices/dev1/channels/" + channel + "/online", "", http.StatusOK, "online true"},
+		{"POST", "/devices/dev1/channels/" + channel + "/offline", "", http.StatusOK, "online false"},
+		{"POST", "/devices/dev1/channels/nochannel/online", "", http.StatusNotFound, ""},
+		{"POST", "/devices/dev1/channels/" + channel + "/media", `{"file": "` + media + `"}`, http.StatusOK, "media " + media},
+		{"POST", "/devices/dev1/channels/" + channel + "/media", `{"file": "/no/such/file"}`, http.StatusUnprocessableEntity, ""},
+		{"POST", "/devices/dev1/channels/" + channel + "/media", `["file"]`, http.StatusBadRequest, ""},
+		{"POST", "/devices/dev1/channels/nochannel/media", `{"file": "` + media + `"}`, http.StatusNotFound, ""},
+		{"POST", "/devices/dev1/sessions/" + callID + "/bye", "", http.StatusOK, "bye"},
+		{"POST", "/devices/dev1/sessions/nocall/bye", "", http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			dev := &stubDevice{id: "dev1"}
+			s := NewServer(xlog.New("api"))
+			s.Add(dev)
+			s.Add(&stubDevice{id: "dev0"})
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body)))
+			if w.Code != tt.code {
+				t.Fatalf("status %d, want %d, body %s", w.Code, tt.code, w.Body.String())
+			}
+			var calls []string
+			if tt.call != "" {
+				calls = []string{tt.call}
+			}
+			if fmt.Sprint(dev.calls) != fmt.Sprint(calls) {
+				t.Errorf("device calls %v, want %v", dev.calls, calls)
+			}
+			// failed actions explain themselves in json
+			if w.Code != http.StatusOK && w.Header().Get("Content-Type") == "application/json" {
+				var e apiError
+				if err := json.Unmarshal(w.Body.Bytes(), &e); err != nil || e.Error == "" {
+					t.Errorf("error body %s", w.Body.String())
+				}
+			} else if w.Code == http.StatusBadRequest || w.Code == http.StatusUnprocessableEntity {
+				t.Errorf("%d without a json error", w.Code)
+			}
+		})
+	}
+}
+
+// The list is sorted by id, a single device is its status.
+func TestServerStatus(t *testing.T) {
+	s := NewServer(xlog.New("api"))
+	s.Add(&stubDevice{id: "dev1"})
+	s.Add(&stubDevice{id: "dev0"})
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/devices", nil))
+	var list []useragent.DeviceStatus
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0].ID != "dev0" || list[1].ID != "dev1" {
+		t.Errorf("list %+v, want dev0 and dev1", list)
+	}
+
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/devices/dev1", nil))
+	var st useragent.DeviceStatus
+	if err := json.Unmarshal(w.Body.Bytes(), &st); err != nil {
+		t.Fatal(err)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	if st.ID != "dev1" || len(st.Channels) != 1 || st.Channels[0].ID != channel {
+		t.Errorf("status %+v", st)
+	}
+}
@@ -0,0 +1,243 @@
+package bench
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/lzh2nix/gb28181Simulator/internal/config"
+	"github.com/lzh2nix/gb28181Simulator/internal/invite"
+	"github.com/lzh2nix/gb28181Simulator/internal/stats"
+	"github.com/lzh2nix/gb28181Simulator/internal/transport"
+	"github.com/lzh2nix/gb28181Simulator/internal/useragent"
+	"github.com/qiniu/x/xlog"
+)
+
+// how long Close waits for the devices to be unregistered
+const closeTimeout = time.Second * 10
+
+var (
+	ErrNoDevices = errors.New("bench.deviceCount must be positive")
+	ErrNoID      = errors.New("bench needs idStart or idTemplate")
+	ErrBadID     = errors.New("id is not a decimal number")
+	ErrIDTooLong = errors.New("id outgrows its digits")
+)
+
+// Runner starts bench.deviceCount virtual devices in one process, each with
+// its own registration, keepalive, catalog and invite state.
+type Runner struct {
+	cfg  *config.Config
+	xlog *xlog.Logger
+	// shared sockets, nil when every device has its own
+	pool *transport.Pool
+	// called for every device that started, e.g. to expose it on the api
+	OnStart func(*useragent.Service)
+
+	mu       sync.Mutex
+	services []*useragent.Service
+	failed   int
+}
+
+func NewRunner(xlog *xlog.Logger, cfg *config.Config) (*Runner, error) {
+	if cfg.Bench.DeviceCount <= 0 {
+		return nil, ErrNoDevices
+	}
+	if cfg.Bench.IDStart == "" && cfg.Bench.IDTemplate == "" {
+		return nil, ErrNoID
+	}
+	// catch a bad id, template or media file before starting anything
+	if _, err := DeviceConfig(cfg, cfg.Bench.DeviceCount-1); err != nil {
+		return nil, err
+	}
+	if err := invite.CheckMedia(cfg); err != nil {
+		return nil, err
+	}
+	r := &Runner{cfg: cfg, xlog: xlog}
+	if cfg.Bench.Sockets > 0 {
+		pool, err := transport.NewPool(xlog, cfg.ServerAddr, cfg.Transport, cfg, cfg.Bench.Sockets)
+		if err != nil {
+			return nil, err
+		}
+		r.pool = pool
+	}
+	return r, nil
+}
+
+// Run starts the devices at the configured ramp-up rate and blocks until
+// SIGINT or SIGTERM, then unregisters all of them and prints the metrics
+// report. SIGUSR1 prints the report without stopping.
+func (r *Runner) Run() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR1)
+
+	var tick <-chan time.Time
+	if r.cfg.Bench.RampUpRate > 0 {
+		t := time.NewTicker(time.Second / time.Duration(r.cfg.Bench.RampUpRate))
+		defer t.Stop()
+		tick = t.C
+	}
+	r.xlog.Infof("starting %d devices, %d/s", r.cfg.Bench.DeviceCount, r.cfg.Bench.RampUpRate)
+	for i := 0; i < r.cfg.Bench.DeviceCount; i++ {
+		for tick != nil {
+			select {
+			case <-tick:
+			case s := <-sig:
+				if s == syscall.SIGUSR1 {
+					stats.Dump(os.Stdout, "")
+					continue
+				}
+				r.xlog.Infof("received signal %s during ramp-up", s)
+				r.finish()
+				return
+			}
+			break
+		}
+		r.start(i)
+	}
+	r.mu.Lock()
+	r.xlog.Infof("%d devices started, %d failed", len(r.services), r.failed)
+	r.mu.Unlock()
+
+	for s := range sig {
+		if s == syscall.SIGUSR1 {
+			stats.Dump(os.Stdout, "")
+			continue
+		}
+		r.xlog.Infof("received signal %s, exiting...", s)
+		break
+	}
+	r.finish()
+}
+
+func (r *Runner) finish() {
+	r.Close()
+	if err := stats.Dump(os.Stdout, r.cfg.ReportFile); err != nil {
+		r.xlog.Errorf("write report failed, err = %v", err)
+	}
+}
+
+func (r *Runner) start(i int) {
+	cfg, err := DeviceConfig(r.cfg, i)
+	if err != nil {
+		r.xlog.Errorf("device %d config failed, err = %v", i, err)
+		r.fail()
+		return
+	}
+	srv, err := r.newService(cfg)
+	if err != nil {
+		r.xlog.Errorf("start device %s failed, err = %v", cfg.GBID, err)
+		r.fail()
+		return
+	}
+	go srv.Serve(context.Background())
+	if r.OnStart != nil {
+		r.OnStart(srv)
+	}
+	r.mu.Lock()
+	r.services = append(r.services, srv)
+	r.mu.Unlock()
+}
+
+func (r *Runner) newService(cfg *config.Config) (*useragent.Service, error) {
+	if r.pool == nil {
+		return useragent.NewService(xlog.New(cfg.GBID), cfg)
+	}
+	ids := []string{cfg.GBID}
+	for _, d := range cfg.Devices {
+		ids = append(ids, d.DeviceID)
+	}
+	tr := r.pool.Endpoint(ids...)
+	return useragent.NewServiceWithTransport(xlog.New(cfg.GBID), cfg, tr), nil
+}
+
+func (r *Runner) fail() {
+	r.mu.Lock()
+	r.failed++
+	r.mu.Unlock()
+}
+
+// Close unregisters every started device in parallel and waits for them to
+// stop.
+func (r *Runner) Close() {
+	r.mu.Lock()
+	services := r.services
+	r.services = nil
+	r.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), closeTimeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, srv := range services {
+		wg.Add(1)
+		go func(srv *useragent.Service) {
+			defer wg.Done()
+			if err := srv.Close(ctx); err != nil {
+				r.xlog.Errorf("stop device %s failed, err = %v", srv.ID(), err)
+			}
+		}(srv)
+	}
+	wg.Wait()
+	if r.pool != nil {
+		r.pool.Close()
+	}
+}
+
+// DeviceConfig derives the config of the i-th (0 based) bench device: its
+// id, credentials, local port unless the devices share sockets, and channel
+// ids shifted by
+// i*len(cfg.Devices) so that no two devices share a channel.
+func DeviceConfig(cfg *config.Config, i int) (*config.Config, error) {
+	dev := *cfg
+	b := cfg.Bench
+	var err error
+	if b.IDTemplate != "" {
+		dev.GBID = fmt.Sprintf(b.IDTemplate, i+1)
+	} else if dev.GBID, err = addID(b.IDStart, i); err != nil {
+		return nil, err
+	}
+	if cfg.LocalSipPort != 0 && b.Sockets <= 0 {
+		dev.LocalSipPort = cfg.LocalSipPort + i
+	}
+	if b.UserName != "" {
+		dev.UserName = expand(b.UserName, dev.GBID, i)
+	}
+	if b.Password != "" {
+		dev.Password = expand(b.Password, dev.GBID, i)
+	}
+	dev.Devices = make([]config.DeviceInfo, len(cfg.Devices))
+	for j, d := range cfg.Devices {
+		if d.DeviceID, err = addID(d.DeviceID, i*len(cfg.Devices)); err != nil {
+			return nil, err
+		}
+		dev.Devices[j] = d
+	}
+	return &dev, nil
+}
+
+func expand(tmpl, id string, i int) string {
+	s := strings.Replace(tmpl, "{id}", id, -1)
+	return strings.Replace(s, "{index}", strconv.Itoa(i+1), -1)
+}
+
+// addID adds n to a decimal gb id keeping its width; 20 digit ids don't
+// fit in an uint64.
+func addID(id string, n int) (string, error) {
+	v, ok := new(big.Int).SetString(id, 10)
+	if !ok {
+		return "", fmt.Errorf("%w: %q", ErrBadID, id)
+	}
+	v.Add(v, big.NewInt(int64(n)))
+	s := fmt.Sprintf("%0*s", len(id), v.String())
+	if len(s) > len(id) {
+		return "", fmt.Errorf("%w: %q + %d", ErrIDTooLong, id, n)
+	}
+	return s, nil
+}
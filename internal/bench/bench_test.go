@@ -0,0 +1,90 @@
+package bench
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/lzh2nix/gb28181Simulator/internal/config"
+)
+
+func TestDeviceConfig(t *testing.T) {
+	channels := []config.DeviceInfo{{DeviceID: "34020000001320000001"}, {DeviceID: "34020000001320000002"}}
+	tests := []struct {
+		name  string
+		cfg   config.Config
+		index int
+		// device id, user name, password, channel ids
+		id, user, password string
+		channels           []string
+		err                error
+	}{
+		{name: "first", cfg: config.Config{Bench: config.BenchConfig{IDStart: "34020000001110000001"}},
+			id: "34020000001110000001"},
+		{name: "carry across digits", cfg: config.Config{Bench: config.BenchConfig{IDStart: "34020000001110000999"}},
+			index: 1, id: "34020000001110001000"},
+		{name: "leading zeros kept", cfg: config.Config{Bench: config.BenchConfig{IDStart: "00000000000000000009"}},
+			index: 1, id: "00000000000000000010"},
+		{name: "outgrows its digits", cfg: config.Config{Bench: config.BenchConfig{IDStart: "99999999999999999999"}},
+			index: 1, err: ErrIDTooLong},
+		{name: "not a number", cfg: config.Config{Bench: config.BenchConfig{IDStart: "3402000000111000000x"}},
+			err: ErrBadID},
+		{name: "template", cfg: config.Config{Bench: config.BenchConfig{IDTemplate: "340200000011100%05d"}},
+			index: 41, id: "34020000001110000042"},
+		{name: "user and password", cfg: config.Config{UserName: "admin", Password: "secret",
+			Bench: config.BenchConfig{IDStart: "34020000001110000001", UserName: "u-{index}", Password: "{id}-pw"}},
+			index: 2, id: "34020000001110000003", user: "u-3", password: "34020000001110000003-pw"},
+		{name: "shared credentials", cfg: config.Config{UserName: "admin", Password: "secret",
+			Bench: config.BenchConfig{IDStart: "34020000001110000001"}},
+			index: 2, id: "34020000001110000003", user: "admin", password: "secret"},
+		{name: "channel offsets", cfg: config.Config{Devices: channels, Bench: config.BenchConfig{IDStart: "34020000001110000001"}},
+			index: 3, id: "34020000001110000004", channels: []string{"34020000001320000007", "34020000001320000008"}},
+		{name: "bad channel id", cfg: config.Config{Devices: []config.DeviceInfo{{DeviceID: "ch"}},
+			Bench: config.BenchConfig{IDStart: "34020000001110000001"}}, err: ErrBadID},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dev, err := DeviceConfig(&tt.cfg, tt.index)
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("err = %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if dev.GBID != tt.id {
+				t.Errorf("id %s, want %s", dev.GBID, tt.id)
+			}
+			if dev.UserName != tt.user || dev.Password != tt.password {
+				t.Errorf("credentials %s/%s, want %s/%s", dev.UserName, dev.Password, tt.user, tt.password)
+			}
+			if len(dev.Devices) != len(tt.channels) {
+				t.Fatalf("%d channels, want %d", len(dev.Devices), len(tt.channels))
+			}
+			for i, ch := range dev.Devices {
+				if ch.DeviceID != tt.channels[i] {
+					t.Errorf("channel %d = %s, want %s", i, ch.DeviceID, tt.channels[i])
+				}
+			}
+			if len(tt.cfg.Devices) > 0 && tt.cfg.Devices[0].DeviceID != channels[0].DeviceID {
+				t.Error("the shared channels were changed")
+			}
+		})
+	}
+}
+
+func TestDeviceConfigPorts(t *testing.T) {
+	cfg := &config.Config{LocalSipPort: 5062, Bench: config.BenchConfig{IDStart: "34020000001110000001"}}
+	dev, err := DeviceConfig(cfg, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dev.LocalSipPort != 5065 {
+		t.Errorf("port %d, want 5065", dev.LocalSipPort)
+	}
+	cfg.Bench.Sockets = 2
+	if dev, _ = DeviceConfig(cfg, 3); dev.LocalSipPort != 5062 {
+		t.Errorf("port %d on shared sockets, want 5062", dev.LocalSipPort)
+	}
+}
@@ -3,9 +3,10 @@ package catalog
 import (
 	"bytes"
 	"encoding/xml"
+	"errors"
 	"log"
-	"net"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/jart/gosip/sip"
@@ -17,7 +18,11 @@ import (
 	"golang.org/x/net/html/charset"
 )
 
+var ErrUnknownChannel = errors.New("unknown channel")
+
 type Catalog struct {
+	// guards the channel status in cfg.Devices
+	mu  sync.Mutex
 	cfg *config.Config
 }
 
@@ -37,9 +42,7 @@ type catalogQuery struct {
 func (catalog *Catalog) Handle(xlog *xlog.Logger, tr *transport.Transport, req *sip.Msg) {
 
 	// 1.send 200 ok response
-	laHost := tr.Conn.LocalAddr().(*net.UDPAddr).IP.String()
-	laPort := tr.Conn.LocalAddr().(*net.UDPAddr).Port
-	resp := catalog.makeCatalogRespFromReq(laHost, laPort, req)
+	resp := catalog.makeCatalogRespFromReq(tr, req)
 	tr.Send <- resp
 	time.Sleep(time.Millisecond * 10)
 	// 2. send catalog msg
@@ -47,24 +50,25 @@ func (catalog *Catalog) Handle(xlog *xlog.Logger, tr *transport.Transport, req *
 	decoder := xml.NewDecoder(bytes.NewReader([]byte(req.Payload.Data())))
 	decoder.CharsetReader = charset.NewReaderLabel
 	if err := decoder.Decode(&q); err != nil {
-		xlog.Errorf("unmarsh xml failed, err = %#v", err, "msg  = ", req)
+		xlog.Errorf("unmarsh xml failed, err = %#v, msg = %v", err, req)
 		return
 	}
 	if err := xml.Unmarshal(req.Payload.Data(), &q); err != nil {
 		log.Println("unmarshal xml failed, err = ", err, "msg = ", req)
 	}
-	catalogInfo := catalog.sendCatalogResp(xlog, laHost, laPort, q.SN, "", "")
-	log.Printf("send catalog\n")
-	go func() {
-		tr.Send <- catalogInfo
-	}()
-	catalogInfo2 := catalog.sendCatalogResp(xlog, laHost, laPort, q.SN, "32011500991320000050", "")
+	resps := catalog.catalogResps(tr, q.SN)
+	log.Printf("send catalog, %d channels\n", len(resps))
 	go func() {
-		tr.Send <- catalogInfo2
+		for _, m := range resps {
+			tr.Send <- m
+		}
 	}()
 }
 
-func (catalog *Catalog) sendCatalogResp(xlog *xlog.Logger, localHost string, localPort int, sn, chid, model string) *sip.Msg {
+// newMessage returns a MESSAGE from the device to the platform, the caller
+// sets the payload.
+func (catalog *Catalog) newMessage(tr *transport.Transport) *sip.Msg {
+	localHost, localPort := tr.ContactAddr()
 
 	req := &sip.Msg{
 		CSeq:       util.GenerateCSeq(),
@@ -78,12 +82,13 @@ func (catalog *Catalog) sendCatalogResp(xlog *xlog.Logger, localHost string, loc
 			Host:   catalog.cfg.Realm,
 		},
 		Via: &sip.Via{
-			Version:  "2.0",
-			Protocol: "SIP",
-			Host:     localHost,
-			Port:     uint16(localPort),
+			Version:   "2.0",
+			Protocol:  "SIP",
+			Transport: tr.Proto(),
+			Host:      transport.ViaHost(localHost),
+			Port:      uint16(localPort),
 
-			Param: &sip.Param{Name: "branch", Value: util.GenerateBranch()},
+			Param: &sip.Param{Name: "branch", Value: util.GenerateBranch(), Next: &sip.Param{Name: "rport"}},
 		},
 		Contact: &sip.Addr{
 			Uri: &sip.URI{
@@ -106,29 +111,78 @@ func (catalog *Catalog) sendCatalogResp(xlog *xlog.Logger, localHost string, loc
 			},
 		},
 	}
+	return req
+}
 
-	devices := make([]config.DeviceInfo, 1)
-	copy(devices, catalog.cfg.Devices)
-	if model != "" {
-		devices[0].Model = model
+// catalogResps answers a catalog query with the channels in cfg.Devices, a
+// MESSAGE per channel so that each fits in a datagram. A device without
+// channels sends one with an empty list.
+func (catalog *Catalog) catalogResps(tr *transport.Transport, sn string) []*sip.Msg {
+	channels := catalog.Channels()
+	var resps []*sip.Msg
+	for i := 0; i == 0 || i < len(channels); i++ {
+		req := catalog.newMessage(tr)
+		list := DeviceList{Num: "0"}
+		if i < len(channels) {
+			list = DeviceList{Num: "1", Item: channels[i : i+1]}
+		}
+		req.Payload = &catalogInfo{
+			CmdType:    "Catalog",
+			SN:         sn,
+			DeviceID:   catalog.cfg.GBID,
+			SumNum:     strconv.Itoa(len(channels)),
+			DeviceList: list,
+		}
+		resps = append(resps, req)
 	}
-	if chid != "" {
-		devices[0].DeviceID = chid
+	return resps
+}
+
+// Channels returns a copy of the channels and their current status.
+func (catalog *Catalog) Channels() []config.DeviceInfo {
+	catalog.mu.Lock()
+	defer catalog.mu.Unlock()
+	return append([]config.DeviceInfo(nil), catalog.cfg.Devices...)
+}
+
+// SetStatus takes a channel online or offline and notifies the platform with
+// an ON or OFF catalog event.
+func (catalog *Catalog) SetStatus(xlog *xlog.Logger, tr *transport.Transport, chid string, online bool) error {
+	status := "OFF"
+	if online {
+		status = "ON"
+	}
+	catalog.mu.Lock()
+	var item *catalogItem
+	for i := range catalog.cfg.Devices {
+		if catalog.cfg.Devices[i].DeviceID == chid {
+			catalog.cfg.Devices[i].Status = status
+			item = &catalogItem{DeviceInfo: catalog.cfg.Devices[i], Event: status}
+			break
+		}
 	}
-	req.Payload = &catalogInfo{
+	catalog.mu.Unlock()
+	if item == nil {
+		return ErrUnknownChannel
+	}
+	req := catalog.newMessage(tr)
+	req.Payload = &catalogNotify{
 		CmdType:  "Catalog",
-		SN:       sn,
+		SN:       strconv.Itoa(util.GenerateCSeq()),
 		DeviceID: catalog.cfg.GBID,
-		SumNum:   strconv.Itoa(len(catalog.cfg.Devices)),
-		DeviceList: DeviceList{
-			//Item: catalog.cfg.Devices,
-			Item: devices,
-			Num:  strconv.Itoa(len(catalog.cfg.Devices)),
+		SumNum:   "1",
+		DeviceList: notifyList{
+			Num:  "1",
+			Item: []catalogItem{*item},
 		},
 	}
-	return req
+	xlog.Infof("[C->S] catalog notify %s %s", chid, status)
+	tr.Send <- req
+	return nil
 }
-func (catalog *Catalog) makeCatalogRespFromReq(localHost string, localPort int, req *sip.Msg) *sip.Msg {
+
+func (catalog *Catalog) makeCatalogRespFromReq(tr *transport.Transport, req *sip.Msg) *sip.Msg {
+	localHost, localPort := tr.ContactAddr()
 	resp := sip.Msg{
 		Status:     200,
 		From:       req.From.Copy(),
@@ -138,11 +192,12 @@ func (catalog *Catalog) makeCatalogRespFromReq(localHost string, localPort int,
 		CSeqMethod: req.CSeqMethod,
 		UserAgent:  version.Version(),
 		Via: &sip.Via{
-			Version:  "2.0",
-			Protocol: "SIP",
-			Host:     localHost,
-			Port:     uint16(localPort),
-			Param:    &sip.Param{Name: "branch", Value: req.Via.Param.Get("branch").Value},
+			Version:   "2.0",
+			Protocol:  "SIP",
+			Transport: tr.Proto(),
+			Host:      transport.ViaHost(localHost),
+			Port:      uint16(localPort),
+			Param:     &sip.Param{Name: "branch", Value: req.Via.Param.Get("branch").Value},
 		},
 	}
 	resp.To.Tag()
@@ -164,6 +219,34 @@ type catalogInfo struct {
 	DeviceList DeviceList `xml:"DeviceList"`
 }
 
+// catalogItem is a channel in a catalog change notification (GB/T 28181-2016
+// §9.6.4), Event is ON, OFF, VLOST, DEFECT, ADD, DEL or UPDATE.
+type catalogItem struct {
+	config.DeviceInfo
+	Event string `xml:"Event"`
+}
+type notifyList struct {
+	Text string        `xml:",chardata"`
+	Num  string        `xml:"Num,attr"`
+	Item []catalogItem `xml:"Item"`
+}
+type catalogNotify struct {
+	XMLName    xml.Name   `xml:"Notify"`
+	CmdType    string     `xml:"CmdType"`
+	SN         string     `xml:"SN"`
+	DeviceID   string     `xml:"DeviceID"`
+	SumNum     string     `xml:"SumNum"`
+	DeviceList notifyList `xml:"DeviceList"`
+}
+
+func (n *catalogNotify) ContentType() string {
+	return "Application/MANSCDP+xml"
+}
+func (n *catalogNotify) Data() []byte {
+	data, _ := xml.MarshalIndent(n, "  ", "    ")
+	return []byte(xml.Header + string(data))
+}
+
 func (cataInfo *catalogInfo) ContentType() string {
 	return "Application/MANSCDP+xml"
 }
@@ -0,0 +1,65 @@
+package catalog
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/lzh2nix/gb28181Simulator/internal/config"
+	"github.com/lzh2nix/gb28181Simulator/internal/transport"
+	"github.com/qiniu/x/xlog"
+)
+
+// The catalog lists the channels of the config and nothing else.
+func TestCatalogResps(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	cfg := &config.Config{GBID: "34020000001110000001", ServerID: "34020000002000000001", Realm: "3402000000"}
+	tr, err := transport.StartSip(xlog.New("catalog-test"), conn.LocalAddr().String(), "udp", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+
+	tests := []struct {
+		name     string
+		channels []string
+	}{
+		{"no channels", nil},
+		{"one", []string{"34020000001320000001"}},
+		{"two", []string{"34020000001320000001", "34020000001320000002"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg.Devices = nil
+			for _, id := range tt.channels {
+				cfg.Devices = append(cfg.Devices, config.DeviceInfo{DeviceID: id, Status: "ON"})
+			}
+			resps := NewCatalog(cfg).catalogResps(tr, "7")
+			want := len(tt.channels)
+			if want == 0 {
+				want = 1
+			}
+			if len(resps) != want {
+				t.Fatalf("%d messages, want %d", len(resps), want)
+			}
+			var got []string
+			for _, m := range resps {
+				info := m.Payload.(*catalogInfo)
+				if info.SN != "7" || info.DeviceID != cfg.GBID || info.SumNum != strconv.Itoa(len(tt.channels)) {
+					t.Errorf("sn %s, device %s, sumNum %s", info.SN, info.DeviceID, info.SumNum)
+				}
+				for _, d := range info.DeviceList.Item {
+					got = append(got, d.DeviceID)
+				}
+			}
+			if strings.Join(got, ",") != strings.Join(tt.channels, ",") {
+				t.Errorf("channels %v, want %v", got, tt.channels)
+			}
+		})
+	}
+}
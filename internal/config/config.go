@@ -17,15 +17,49 @@ type Config struct {
 	KeepaliveInterval int          `json:"keepaliveInterval"`
 	MaxKeepaliveRetry int          `json:"maxKeepaliveRetry"`
 	Transport         string       `json:"transport"`
+	AllowedPeers      []string     `json:"allowedPeers"`
+	AdvertisedIP      string       `json:"advertisedIP"`
+	AdvertisedMediaIP string       `json:"advertisedMediaIP"`
+	TLSCAFile         string       `json:"tlsCaFile"`
+	TLSCertFile       string       `json:"tlsCertFile"`
+	TLSKeyFile        string       `json:"tlsKeyFile"`
+	TLSServerName     string       `json:"tlsServerName"`
 	GBID              string       `json:"gbID"`
 	Devices           []DeviceInfo `json:"devices"`
-	DetailLog         bool
+	Bench             BenchConfig  `json:"bench"`
+	// where to write the metrics report on exit, .csv or .json
+	ReportFile string `json:"reportFile"`
+	// address of the prometheus /metrics endpoint, empty disables it
+	MetricsAddr string `json:"metricsAddr"`
+	// address of the http control api, empty disables it
+	APIAddr string `json:"apiAddr"`
+	// concurrent INVITE sessions of the device and, unless the channel sets
+	// its own, of each channel; 0 means no limit
+	MaxSessions        int `json:"maxSessions"`
+	MaxChannelSessions int `json:"maxChannelSessions"`
+	DetailLog          bool
+}
+
+// BenchConfig describes the virtual devices started by the bench command.
+// Device ids come from IDTemplate formatted with the device index (1 based)
+// or, without a template, count up from IDStart. In UserName and Password
+// "{id}" and "{index}" are replaced per device.
+type BenchConfig struct {
+	DeviceCount int    `json:"deviceCount"`
+	IDStart     string `json:"idStart"`
+	IDTemplate  string `json:"idTemplate"`
+	// devices started per second, 0 starts them all at once
+	RampUpRate int    `json:"rampUpRate"`
+	UserName   string `json:"userName"`
+	Password   string `json:"password"`
+	// devices share this many sockets, 0 gives every device its own
+	Sockets int `json:"sockets"`
 }
 
 type DeviceInfo struct {
 	Text         string `xml:",chardata"`
 	DeviceID     string `xml:"DeviceID" json:"deviceID"`
-	Name         string `xml:"Name" json:"name""`
+	Name         string `xml:"Name" json:"name"`
 	Manufacturer string `xml:"Manufacturer" json:"manufacturer"`
 	Model        string `xml:"Model" json:"model"`
 	Owner        string `xml:"Owner" json:"owner"`
@@ -36,6 +70,36 @@ type DeviceInfo struct {
 	RegisterWay  string `xml:"RegisterWay" json:"registerWay"`
 	Secrecy      string `xml:"Secrecy" json:"secrecy"`
 	Status       string `xml:"Status" json:"status"`
+	// overrides Config.MaxChannelSessions when set
+	MaxSessions int `xml:"-" json:"maxSessions"`
+	// what the channel streams when invited
+	Media MediaConfig `xml:"-" json:"media"`
+}
+
+// MediaConfig is the source a channel streams. A channel without a file plays
+// test.dat from the working directory.
+type MediaConfig struct {
+	File string `json:"file"`
+	// format of File: ps (pre-muxed MPEG-PS), h264 or h265 (Annex-B), mp4,
+	// flv or ts; by the file extension when unset, ps for unknown ones
+	Codec string `json:"codec"`
+	// frames, ps packs for a ps file, per second; 25 when unset. Containers
+	// have timestamps of their own.
+	FrameRate int `json:"frameRate"`
+	// audio muxed with the video of File, replacing the audio track of a
+	// container: raw G.711 (g711a, g711u) or ADTS AAC (aac). AudioCodec goes
+	// by the extension when unset, .g711a/.alaw/.pcma, .g711u/.ulaw/.pcmu or
+	// .aac.
+	AudioFile  string `json:"audioFile"`
+	AudioCodec string `json:"audioCodec"`
+	// start over at the end of File, the default; with false the device
+	// hangs up once File has been sent
+	Loop *bool `json:"loop"`
+}
+
+// Looping tells whether the source starts over at its end.
+func (m MediaConfig) Looping() bool {
+	return m.Loop == nil || *m.Loop
 }
 
 func ParseJsonConfig(f *string) (*Config, error) {
@@ -51,6 +115,26 @@ func ParseJsonConfig(f *string) (*Config, error) {
 		return nil, err
 	}
 	var cfg Config
-	err = json.Unmarshal(b, &cfg)
-	return &cfg, err
+	if err = json.Unmarshal(b, &cfg); err != nil {
+		return nil, err
+	}
+	cfg.SetDefaults()
+	return &cfg, nil
+}
+
+// SetDefaults fills in the values of sim.conf for an unset transport and
+// unset or non-positive register and keepalive timers.
+func (c *Config) SetDefaults() {
+	if c.Transport == "" {
+		c.Transport = "udp"
+	}
+	if c.RegExpire <= 0 {
+		c.RegExpire = 3600
+	}
+	if c.KeepaliveInterval <= 0 {
+		c.KeepaliveInterval = 60
+	}
+	if c.MaxKeepaliveRetry <= 0 {
+		c.MaxKeepaliveRetry = 3
+	}
 }
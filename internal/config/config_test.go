@@ -0,0 +1,49 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// A config without timers gets the ones of sim.conf, a bench config goes
+// through the same path.
+func TestParseJsonConfigDefaults(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sim-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name string
+		json string
+		want Config
+	}{
+		{"unset", `{"serverAddr": "127.0.0.1:5060", "bench": {"deviceCount": 10}}`,
+			Config{Transport: "udp", RegExpire: 3600, KeepaliveInterval: 60, MaxKeepaliveRetry: 3}},
+		{"negative", `{"regExpire": -1, "keepaliveInterval": -5, "maxKeepaliveRetry": -1}`,
+			Config{Transport: "udp", RegExpire: 3600, KeepaliveInterval: 60, MaxKeepaliveRetry: 3}},
+		{"set", `{"transport": "tcp", "regExpire": 600, "keepaliveInterval": 30, "maxKeepaliveRetry": 5}`,
+			Config{Transport: "tcp", RegExpire: 600, KeepaliveInterval: 30, MaxKeepaliveRetry: 5}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(dir, tt.name+".conf")
+			if err := ioutil.WriteFile(file, []byte(tt.json), 0600); err != nil {
+				t.Fatal(err)
+			}
+			cfg, err := ParseJsonConfig(&file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.Transport != tt.want.Transport || cfg.RegExpire != tt.want.RegExpire ||
+				cfg.KeepaliveInterval != tt.want.KeepaliveInterval || cfg.MaxKeepaliveRetry != tt.want.MaxKeepaliveRetry {
+				t.Errorf("got transport %s, regExpire %d, keepaliveInterval %d, maxKeepaliveRetry %d, want %s, %d, %d, %d",
+					cfg.Transport, cfg.RegExpire, cfg.KeepaliveInterval, cfg.MaxKeepaliveRetry,
+					tt.want.Transport, tt.want.RegExpire, tt.want.KeepaliveInterval, tt.want.MaxKeepaliveRetry)
+			}
+		})
+	}
+}
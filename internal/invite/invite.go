@@ -1,13 +1,15 @@
 package invite
 
 import (
-	"io/ioutil"
+	"errors"
+	"fmt"
 	"log"
 	"math/rand"
 	"net"
-	"os"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -15,12 +17,25 @@ import (
 	"github.com/jart/gosip/sip"
 	"github.com/jart/gosip/util"
 	"github.com/lzh2nix/gb28181Simulator/internal/config"
+	"github.com/lzh2nix/gb28181Simulator/internal/media"
 	"github.com/lzh2nix/gb28181Simulator/internal/streams/packet"
 	"github.com/lzh2nix/gb28181Simulator/internal/transport"
 	"github.com/lzh2nix/gb28181Simulator/internal/version"
 	"github.com/qiniu/x/xlog"
+)
+
+// file played when no source is set for the channel
+const defaultMediaFile = "test.dat"
 
-	"github.com/nareix/joy4/format"
+var ErrNoSession = errors.New("no such session")
+
+// statuses of an INVITE we don't accept
+const (
+	statusNotFound               = 404
+	statusTemporarilyUnavailable = 480
+	statusBusyHere               = 486
+	statusNotAcceptable          = 488
+	statusServerInternalError    = 500
 )
 
 const (
@@ -42,31 +57,55 @@ type sdpRemoteInfo struct {
 	proto string
 	lPort int
 	lip   string
+	// protocol of the offered m= line, TCP/RTP/AVP or RTP/AVP
+	sdpProto string
+	// rtp payload type the platform offered for ps
+	pt int
 }
+
+func (r *sdpRemoteInfo) addr() string {
+	return net.JoinHostPort(r.ip, strconv.Itoa(r.port))
+}
+
 type Invite struct {
-	cfg    *config.Config
-	state  int32
-	leg    *Leg
-	remote *sdpRemoteInfo
-	rtp    *packet.RtpTransfer
-	byed   chan bool
-	sdp    *sdp.SDP
+	cfg *config.Config
+	// the channels with their current status, kept by the catalog
+	channels func() []config.DeviceInfo
+	// guards sessions and media against the control api
+	mu sync.Mutex
+	// by Call-ID
+	sessions map[string]*session
+	// media source overrides by channel id
+	media map[string]string
+	// media routines, waited for by Close
+	wg sync.WaitGroup
 }
 
-func init() {
-	format.RegisterAll()
+// SessionInfo describes an INVITE session for the control api.
+type SessionInfo struct {
+	CallID    string `json:"callId"`
+	Channel   string `json:"channel"`
+	State     string `json:"state"`
+	Remote    string `json:"remote"`
+	Transport string `json:"transport"`
+	Media     string `json:"media"`
 }
-func NewInvite(cfg *config.Config) *Invite {
+
+func NewInvite(cfg *config.Config, channels func() []config.DeviceInfo) *Invite {
 	rand.Seed(time.Now().UnixNano())
-	return &Invite{cfg: cfg, state: idle, byed: make(chan bool)}
+	return &Invite{cfg: cfg, channels: channels, sessions: make(map[string]*session), media: make(map[string]string)}
 }
 
 func (inv *Invite) HandleMsg(xlog *xlog.Logger, tr *transport.Transport, m *sip.Msg) {
-	if m.CSeqMethod == sip.MethodInvite && strings.ToUpper(m.Payload.ContentType()) == "APPLICATION/SDP" {
+	if m.CSeqMethod == sip.MethodInvite && !m.IsResponse() {
 		log.Println("recv invite msg")
 		inv.InviteMsg(xlog, tr, m)
 		return
 	}
+	if m.CSeqMethod == sip.MethodInvite && m.Status == 408 {
+		inv.ackTimeout(xlog, tr, m)
+		return
+	}
 	if m.CSeqMethod == sip.MethodAck {
 		inv.AckMsg(xlog, tr, m)
 		return
@@ -78,19 +117,47 @@ func (inv *Invite) HandleMsg(xlog *xlog.Logger, tr *transport.Transport, m *sip.
 		return
 	}
 
-	xlog.Info("recv msg at ", inv.state, m)
+	xlog.Info("recv msg ", m)
+}
+
+// session returns the session of an in-dialog request, nil if it has none.
+func (inv *Invite) session(m *sip.Msg) *session {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	s, ok := inv.sessions[m.CallID]
+	if !ok || !strings.EqualFold(s.leg.fromTag, m.From.Param.Get("tag").Value) {
+		return nil
+	}
+	return s
 }
 func (inv *Invite) InviteMsg(xlog *xlog.Logger, tr *transport.Transport, m *sip.Msg) {
-	// only handle invite idle state
-	if atomic.LoadInt32(&inv.state) != idle {
+	ch, ok := inv.channel(m.Request.User)
+	if !ok {
+		inv.reject(xlog, tr, m, statusNotFound)
+		return
+	}
+	if strings.EqualFold(ch.Status, "OFF") {
+		inv.reject(xlog, tr, m, statusTemporarilyUnavailable)
+		return
+	}
+	if m.Payload == nil || !strings.EqualFold(m.Payload.ContentType(), "application/sdp") {
+		inv.reject(xlog, tr, m, statusNotAcceptable)
 		return
 	}
 	sdp, err := sdp.Parse(string(m.Payload.Data()))
 	if err != nil {
 		xlog.Error("parse sdp failed, err = ", err)
+		inv.reject(xlog, tr, m, statusNotAcceptable)
+		return
+	}
+	laHost, _ := tr.LocalAddr()
+	if !sameFamily(laHost, sdp.Addr) {
+		// dual-stack platform asking for media over the other ip family
+		laHost = ""
+		if ip, err := transport.OutboundIP(sdp.Addr); err == nil {
+			laHost = ip.String()
+		}
 	}
-	laHost := tr.Conn.LocalAddr().(*net.UDPAddr).IP.String()
-	laPort := tr.Conn.LocalAddr().(*net.UDPAddr).Port
 	r := &sdpRemoteInfo{
 		ssrc: ssrc(sdp),
 		ip:   sdp.Addr,
@@ -98,14 +165,29 @@ func (inv *Invite) InviteMsg(xlog *xlog.Logger, tr *transport.Transport, m *sip.
 		lPort: randomFromStartEnd(10000, 65535),
 		lip:   laHost,
 	}
-	proto := ""
+	offer := sdp.Video
 	if sdp.Session == "Talk" {
-		r.port = int(sdp.Audio.Port)
-		proto = sdp.Audio.Proto
-	} else {
-		r.port = int(sdp.Video.Port)
-		proto = sdp.Video.Proto
+		offer = sdp.Audio
+	}
+	if offer == nil {
+		xlog.Info("sdp offer without media for session ", sdp.Session)
+		inv.reject(xlog, tr, m, statusNotAcceptable)
+		return
 	}
+	r.port = int(offer.Port)
+	r.sdpProto = offer.Proto
+	r.pt = packet.PayloadTypePS
+	if sdp.Session != "Talk" {
+		// ps is all we send, whatever else is offered
+		c, ok := psCodec(offer)
+		if !ok {
+			xlog.Info("sdp offer without PS, codecs: ", offer.Codecs)
+			inv.reject(xlog, tr, m, statusNotAcceptable)
+			return
+		}
+		r.pt = int(c.PT)
+	}
+	proto := offer.Proto
 	if strings.HasPrefix(proto, "TCP") {
 		r.proto = "TCP"
 	} else {
@@ -113,16 +195,80 @@ func (inv *Invite) InviteMsg(xlog *xlog.Logger, tr *transport.Transport, m *sip.
 	}
 	xlog.Info("[S->C] invite ", r.proto, "ssrc:", r.ssrc, "callId:", m.CallID)
 
-	inv.remote = r
-	inv.sdp = sdp
-
-	resp := inv.makeRespFromReq(laHost, laPort, m, true, 200)
-	inv.leg = &Leg{m.CallID, m.From.Param.Get("tag").Value, resp.To.Param.Get("tag").Value}
-	atomic.StoreInt32(&inv.state, completed)
+	s := &session{
+		req:       m,
+		remote:    r,
+		sdp:       sdp,
+		channel:   ch.DeviceID,
+		stop:      make(chan struct{}),
+		invitedAt: time.Now(),
+	}
+	s.media = inv.mediaConfig(ch)
+	if s.video, s.audio, err = media.Codecs(s.media); err != nil {
+		xlog.Errorf("media of channel %s, err = %v", ch.DeviceID, err)
+		inv.reject(xlog, tr, m, statusServerInternalError)
+		return
+	}
+	resp := inv.makeRespFromReq(tr, s, m, true, 200)
+	s.leg = &Leg{m.CallID, m.From.Param.Get("tag").Value, resp.To.Param.Get("tag").Value}
+	if code := inv.add(s, ch.MaxSessions); code != 0 {
+		inv.reject(xlog, tr, m, code)
+		return
+	}
+	s.setState(completed)
 	xlog.Info("[C->S] 200OK(Invite)")
 	tr.Send <- resp
 }
-func (inv *Invite) makeRespFromReq(localHost string, localPort int, req *sip.Msg, invite bool, code int) *sip.Msg {
+
+// channel looks up the channel addressed by an INVITE's Request-URI.
+func (inv *Invite) channel(chid string) (config.DeviceInfo, bool) {
+	for _, d := range inv.channels() {
+		if d.DeviceID == chid {
+			return d, true
+		}
+	}
+	return config.DeviceInfo{}, false
+}
+
+func (inv *Invite) reject(xlog *xlog.Logger, tr *transport.Transport, m *sip.Msg, code int) {
+	xlog.Infof("[C->S] %d(Invite), channel:%s callId:%s", code, m.Request.User, m.CallID)
+	tr.Send <- inv.makeRespFromReq(tr, nil, m, false, code)
+}
+
+// add starts tracking s unless the device or its channel already has as many
+// sessions as allowed, it returns the status to reject the INVITE with then.
+// max is the channel's own limit, 0 for the configured default. A re-INVITE
+// of an existing dialog is not supported.
+func (inv *Invite) add(s *session, max int) int {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	if _, ok := inv.sessions[s.leg.callID]; ok {
+		return statusNotAcceptable
+	}
+	if inv.cfg.MaxSessions > 0 && len(inv.sessions) >= inv.cfg.MaxSessions {
+		return statusBusyHere
+	}
+	if max == 0 {
+		max = inv.cfg.MaxChannelSessions
+	}
+	if max > 0 {
+		n := 0
+		for _, other := range inv.sessions {
+			if other.channel == s.channel {
+				n++
+			}
+		}
+		if n >= max {
+			return statusBusyHere
+		}
+	}
+	inv.sessions[s.leg.callID] = s
+	return 0
+}
+
+// makeRespFromReq answers req, s is its session or nil when it has none.
+func (inv *Invite) makeRespFromReq(tr *transport.Transport, s *session, req *sip.Msg, invite bool, code int) *sip.Msg {
+	localHost, localPort := tr.ContactAddr()
 	resp := &sip.Msg{
 		Status:     code,
 		From:       req.From.Copy(),
@@ -132,39 +278,98 @@ func (inv *Invite) makeRespFromReq(localHost string, localPort int, req *sip.Msg
 		CSeqMethod: req.CSeqMethod,
 		UserAgent:  version.Version(),
 		Via: &sip.Via{
-			Version:  "2.0",
-			Protocol: "SIP",
-			Host:     localHost,
-			Port:     uint16(localPort),
-			Param:    &sip.Param{Name: "branch", Value: req.Via.Param.Get("branch").Value},
+			Version:   "2.0",
+			Protocol:  "SIP",
+			Transport: tr.Proto(),
+			Host:      transport.ViaHost(localHost),
+			Port:      uint16(localPort),
+			Param:     &sip.Param{Name: "branch", Value: req.Via.Param.Get("branch").Value},
 		},
 	}
 
 	if invite && code == 200 {
 		resp.To.Tag()
+		resp.Contact = &sip.Addr{
+			Uri: &sip.URI{
+				User: inv.cfg.GBID,
+				Host: localHost,
+				Port: uint16(localPort),
+			},
+		}
+		mediaHost := inv.mediaIP(tr, s.remote)
 		sdp := &sdp.SDP{
-			Origin:  sdp.Origin{User: inv.cfg.GBID, Addr: localHost},
+			Origin:  sdp.Origin{User: inv.cfg.GBID, Addr: mediaHost},
 			Session: "play",
-			Addr:    localHost,
+			Addr:    mediaHost,
 			Video: &sdp.Media{
-				//Proto:  inv.remote.proto + "/RTP/AVP",
-				Proto: "TCP/RTP/AVP",
-
-				Codecs: []sdp.Codec{{PT: uint8(96), Rate: 90000, Name: "PS"}},
-				Port:   uint16(inv.remote.lPort)},
+				Proto:  s.remote.sdpProto,
+				Codecs: []sdp.Codec{{PT: uint8(s.remote.pt), Rate: 90000, Name: "PS"}},
+				Port:   uint16(s.remote.lPort)},
 			SendOnly: true,
-			Other:    [][2]string{{"y", strconv.Itoa(inv.remote.ssrc)}},
+			Other:    [][2]string{{"y", strconv.Itoa(s.remote.ssrc)}},
+		}
+		if s.remote.proto == "TCP" {
+			// we connect to the platform, on a new connection per session
+			sdp.Attrs = append(sdp.Attrs, [2]string{"setup", "active"}, [2]string{"connection", "new"})
+		}
+		if s.sdp.Session != "Talk" {
+			sdp.Other = append(sdp.Other, [2]string{"f", formatLine(s.video, s.audio)})
 		}
 		resp.Payload = sdp
 	} else {
 		toTag := util.GenerateTag()
-		if inv.leg != nil {
-			toTag = inv.leg.toTag
+		if s != nil && s.leg != nil {
+			toTag = s.leg.toTag
 		}
 		resp.To.Param = &sip.Param{Name: "tag", Value: toTag}
 	}
 	return resp
 }
+
+// psCodec finds PS among the codecs of an offered media.
+func psCodec(m *sdp.Media) (sdp.Codec, bool) {
+	for _, c := range m.Codecs {
+		if strings.EqualFold(c.Name, "PS") {
+			return c, true
+		}
+	}
+	return sdp.Codec{}, false
+}
+
+// GB28181 f= line codes of the codecs inside the ps
+var (
+	fVideoCodecs = map[string]string{media.CodecH264: "2", media.CodecH265: "5"}
+	fAudioCodecs = map[string]string{media.CodecG711A: "1", media.CodecG711U: "1"}
+)
+
+// formatLine is the GB28181 f= line telling the platform what is inside the
+// ps: v/codec/resolution/frame rate/rate type/bit rate followed by
+// a/codec/bit rate/sample rate, fields we don't know are left empty.
+func formatLine(video, audio string) string {
+	return "v/" + fVideoCodecs[video] + "////a/" + fAudioCodecs[audio] + "//"
+}
+
+// mediaIP is the address put in the SDP answer, the advertised media ip if
+// one is configured and our signalling address otherwise.
+func (inv *Invite) mediaIP(tr *transport.Transport, remote *sdpRemoteInfo) string {
+	if inv.cfg.AdvertisedMediaIP != "" {
+		return inv.cfg.AdvertisedMediaIP
+	}
+	host, _ := tr.ContactAddr()
+	if !sameFamily(host, remote.ip) {
+		return remote.lip
+	}
+	return host
+}
+
+func sameFamily(a, b string) bool {
+	ipa, ipb := net.ParseIP(a), net.ParseIP(b)
+	if ipa == nil || ipb == nil {
+		return true
+	}
+	return (ipa.To4() == nil) == (ipb.To4() == nil)
+}
+
 func ssrc(sdp *sdp.SDP) int {
 	for _, i := range sdp.Other {
 		if i[0] == "y" {
@@ -176,150 +381,209 @@ func ssrc(sdp *sdp.SDP) int {
 }
 
 func (inv *Invite) AckMsg(xlog *xlog.Logger, tr *transport.Transport, m *sip.Msg) {
-	// only handle invite idle state
-	if atomic.LoadInt32(&inv.state) != completed ||
-		inv.leg.callID != m.CallID ||
-		!strings.EqualFold(inv.leg.fromTag, m.From.Param.Get("tag").Value) {
+	s := inv.session(m)
+	// only handle the ACK of a 200 OK we sent
+	if s == nil || atomic.LoadInt32(&s.state) != completed {
 		return
 	}
 	xlog.Info("[S->C] invite ack")
-	atomic.StoreInt32(&inv.state, confirmed)
+	s.setState(confirmed)
 	// start send rtp
-	if inv.sdp.Session == "Talk" {
+	inv.wg.Add(1)
+	if s.sdp.Session == "Talk" {
 		log.Println("invite talk")
-		go inv.sendTalkRTPPacket(xlog)
+		go func() {
+			defer inv.wg.Done()
+			s.sendTalkRTPPacket(xlog)
+		}()
 	} else {
-		inv.sendRTPPacket(xlog)
+		go func() {
+			defer inv.wg.Done()
+			if s.sendRTPPacket(xlog) {
+				inv.hangup(xlog, tr, s)
+			}
+		}()
+	}
+}
+
+// ackTimeout hangs up a session whose 200 OK was never acknowledged, it
+// would count against the session limits forever otherwise
+// (RFC 3261 §13.3.1.4).
+func (inv *Invite) ackTimeout(xlog *xlog.Logger, tr *transport.Transport, m *sip.Msg) {
+	s := inv.session(m)
+	if s == nil || atomic.LoadInt32(&s.state) != completed {
+		return
 	}
+	xlog.Error("no ack for 200OK(Invite), hang up callId:", m.CallID)
+	inv.hangup(xlog, tr, s)
 }
 
 func randomFromStartEnd(min, max int) int {
 
 	return rand.Intn(max-min+1) + min
 }
-func (inv *Invite) sendRTPPacket(xlog *xlog.Logger) {
-	//time.Sleep(10 * time.Second)
-	//if inv.rtp != nil {
-	//xlog.Info("rtp routine already exist, exit")
-	//return
-	//}
-	var rtp *packet.RtpTransfer
-	if inv.remote.proto == "UDP" {
-		log.Println("new rtp transfer over udp, ip:", inv.remote.ip, "port:", inv.remote.port, "ssrc:", inv.remote.ssrc)
-		rtp = packet.NewRRtpTransfer("", packet.UDPTransfer, inv.remote.ssrc)
-	} else {
-		log.Println("new rtp transfer over tcp, ssrc:", inv.remote.ssrc, "callid:", inv.leg.callID)
-		//rtp = packet.NewRRtpTransfer("", packet.UDPTransfer, inv.remote.ssrc)
-		rtp = packet.NewRRtpTransfer("", packet.TCPTransferActive, inv.remote.ssrc)
-	}
-	inv.rtp = rtp
-	// send ip,port and recv ip,port
-	err := inv.rtp.Service(inv.remote.lip, inv.remote.ip, inv.remote.lPort, inv.remote.port)
-	if err != nil {
-		xlog.Info("connect failed, err = ", err)
+
+func (inv *Invite) ByeMsg(xlog *xlog.Logger, tr *transport.Transport, m *sip.Msg) {
+	// only handle invite idle state
+	if m.IsResponse() {
+		return
 	}
-	f, err := os.Open("test.dat")
-	if err != nil {
-		xlog.Errorf("read file error(%v)", err)
-		rtp.Exit()
+	xlog.Info("[S->C] bye, callId:", m.CallID)
+	s := inv.session(m)
+	if s == nil {
+		resp := inv.makeRespFromReq(tr, nil, m, false, 481)
+		xlog.Info("[C->S] 481(Bye)")
+		tr.Send <- resp
 		return
 	}
+	resp := inv.makeRespFromReq(tr, s, m, false, 200)
+	inv.end(xlog, s)
+	xlog.Info("[C->S] 200OK(Bye)")
+	tr.Send <- resp
+}
 
-	defer func() {
-		log.Println("exit send rtp pkt routine callid:", inv.leg.callID, "ssrc:", inv.remote.ssrc)
-		f.Close()
-		rtp.Exit()
-		inv.rtp = nil
-	}()
-
-	buf, _ := ioutil.ReadAll(f)
-	for {
-		select {
-		case <-inv.byed:
-			log.Println("got signal inv.byed exit")
-			goto end
-		default:
-			inv.sendFile(buf, rtp)
-		}
+// end removes the session and tells its media routine to exit, false if it
+// had ended already.
+func (inv *Invite) end(xlog *xlog.Logger, s *session) bool {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	if inv.sessions[s.leg.callID] != s {
+		return false
 	}
-end:
+	delete(inv.sessions, s.leg.callID)
+	s.setState(idle)
+	xlog.Info("stop media, callId:", s.leg.callID)
+	close(s.stop)
+	return true
 }
 
-func (inv *Invite) sendTalkRTPPacket(xlog *xlog.Logger) {
-	log.Println("new rtp talk transfer over tcp, ssrc:", inv.remote.ssrc, "callid:", inv.leg.callID)
-	rtp := packet.NewRRtpTransfer("", packet.TCPTransferActive, inv.remote.ssrc)
-	err := rtp.Service(inv.remote.lip, inv.remote.ip, inv.remote.lPort, inv.remote.port)
-	if err != nil {
-		xlog.Info("connect failed, err = ", err)
-		return
+// Close hangs up the current sessions and returns once their media routines
+// have exited.
+func (inv *Invite) Close(xlog *xlog.Logger, tr *transport.Transport) {
+	for _, info := range inv.Sessions() {
+		inv.Hangup(xlog, tr, info.CallID)
 	}
-	log.Println("start send rtp talk pkt")
-	rtp.SendTalkRtp()
+	inv.wg.Wait()
 }
 
-var i = 0
-var pts uint64 = 0
-var last = 0
+// Sessions lists the current INVITE sessions ordered by Call-ID.
+func (inv *Invite) Sessions() []SessionInfo {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	var list []SessionInfo
+	for _, s := range inv.sessions {
+		list = append(list, s.info())
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CallID < list[j].CallID })
+	return list
+}
 
-func (inv *Invite) sendFile(buf []byte, rtp *packet.RtpTransfer) {
-	if isPsHead(buf[i : i+4]) {
-		stop := rtp.SendPSdata(buf[last:i], false, pts)
-		if stop {
-			return
-		}
-		pts += 40
-		time.Sleep(time.Millisecond * 40)
-		last = i
+// SetMediaSource makes the channel play file from the next INVITE on, with
+// the codec and timing of its media config.
+func (inv *Invite) SetMediaSource(chid, file string) error {
+	ch, _ := inv.channel(chid)
+	c := ch.Media
+	c.File = file
+	if err := media.Check(c); err != nil {
+		return err
+	}
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	inv.media[chid] = file
+	return nil
+}
+
+// mediaConfig is what an INVITE of the channel plays.
+func (inv *Invite) mediaConfig(ch config.DeviceInfo) config.MediaConfig {
+	c := ch.Media
+	inv.mu.Lock()
+	if f, ok := inv.media[ch.DeviceID]; ok {
+		c.File = f
 	}
-	i++
-	if i == len(buf) {
-		log.Println("reset i to 0")
-		i = 0
+	inv.mu.Unlock()
+	if c.File == "" {
+		c.File = defaultMediaFile
 	}
+	return c
 }
-func isPsHead(buf []byte) bool {
-	h := []byte{0, 0, 1, 186}
-	if len(buf) == 4 {
-		for i := 0; i < 4; i++ {
-			if buf[i] != h[i] {
-				return false
+
+// CheckMedia checks the media files set for the channels. Those without one
+// play test.dat, which only gets a warning when it is missing or invalid so
+// that the device still registers and answers catalog queries; their INVITEs
+// are rejected then.
+func CheckMedia(cfg *config.Config) error {
+	warned := false
+	for _, d := range cfg.Devices {
+		c := d.Media
+		if c.File == "" {
+			c.File = defaultMediaFile
+			if err := media.Check(c); err != nil && !warned {
+				log.Printf("warning: channels without a media file can't be played, err = %v", err)
+				warned = true
 			}
+			continue
+		}
+		if err := media.Check(c); err != nil {
+			return fmt.Errorf("channel %s media: %w", d.DeviceID, err)
 		}
-		return true
 	}
-	return false
+	return nil
 }
 
-func (inv *Invite) ByeMsg(xlog *xlog.Logger, tr *transport.Transport, m *sip.Msg) {
-	// only handle invite idle state
-	if m.IsResponse() {
-		return
+// Hangup ends the session from the device side with a BYE.
+func (inv *Invite) Hangup(xlog *xlog.Logger, tr *transport.Transport, callID string) error {
+	inv.mu.Lock()
+	s, ok := inv.sessions[callID]
+	inv.mu.Unlock()
+	if !ok || !inv.hangup(xlog, tr, s) {
+		return ErrNoSession
 	}
-	xlog.Info("[S->C] bye, callId:", m.CallID)
-	laHost := tr.Conn.LocalAddr().(*net.UDPAddr).IP.String()
-	laPort := tr.Conn.LocalAddr().(*net.UDPAddr).Port
-	xlog.Info("inv.state:", inv.state, "callId:", m.CallID)
-	if atomic.LoadInt32(&inv.state) != confirmed ||
-		inv.leg.callID != m.CallID ||
-		!strings.EqualFold(inv.leg.fromTag, m.From.Param.Get("tag").Value) {
-		resp := inv.makeRespFromReq(laHost, laPort, m, false, 481)
-		xlog.Info("[C->S] 481(Bye)")
-		tr.Send <- resp
-		atomic.StoreInt32(&inv.state, idle)
-		return
+	return nil
+}
+
+// hangup sends a BYE for s unless it has ended already.
+func (inv *Invite) hangup(xlog *xlog.Logger, tr *transport.Transport, s *session) bool {
+	if !inv.end(xlog, s) {
+		return false
+	}
+	xlog.Info("[C->S] bye, callId:", s.leg.callID)
+	tr.Send <- inv.makeBye(tr, s.req, s.leg)
+	return true
+}
+
+// makeBye builds a BYE within the dialog of the INVITE req, our From is its
+// To and the request goes to its Contact.
+func (inv *Invite) makeBye(tr *transport.Transport, req *sip.Msg, leg *Leg) *sip.Msg {
+	localHost, localPort := tr.ContactAddr()
+	target := req.From.Uri
+	if req.Contact != nil {
+		target = req.Contact.Uri
+	}
+	from := req.To.Copy()
+	from.Param = &sip.Param{Name: "tag", Value: leg.toTag}
+	return &sip.Msg{
+		Method:     sip.MethodBye,
+		CSeqMethod: sip.MethodBye,
+		CSeq:       util.GenerateCSeq(),
+		CallID:     leg.callID,
+		UserAgent:  version.Version(),
+		Request:    target.Copy(),
+		Via: &sip.Via{
+			Version:   "2.0",
+			Protocol:  "SIP",
+			Transport: tr.Proto(),
+			Host:      transport.ViaHost(localHost),
+			Port:      uint16(localPort),
+			Param:     &sip.Param{Name: "branch", Value: util.GenerateBranch(), Next: &sip.Param{Name: "rport"}},
+		},
+		From: from,
+		To:   req.From.Copy(),
+		Contact: &sip.Addr{
+			Uri: &sip.URI{
+				User: inv.cfg.GBID,
+				Host: localHost,
+				Port: uint16(localPort),
+			},
+		},
 	}
-	resp := inv.makeRespFromReq(laHost, laPort, m, false, 200)
-	atomic.StoreInt32(&inv.state, idle)
-	xlog.Info("[C->S] 200OK(Bye)")
-	tr.Send <- resp
-	xlog.Info("notify inv.byed")
-	timeout := time.NewTimer(time.Millisecond * 500)
-	select {
-	case inv.byed <- true:
-		break
-	case <-timeout.C:
-		xlog.Info("notify inv.byed timeout")
-		break
-	}
-	xlog.Info("notify inv.byed done")
 }
@@ -0,0 +1,287 @@
+package invite
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/jart/gosip/sdp"
+	"github.com/jart/gosip/sip"
+	"github.com/lzh2nix/gb28181Simulator/internal/config"
+	"github.com/lzh2nix/gb28181Simulator/internal/media"
+	"github.com/lzh2nix/gb28181Simulator/internal/streams/packet"
+	"github.com/lzh2nix/gb28181Simulator/internal/transport"
+	"github.com/qiniu/x/xlog"
+)
+
+// Media files set for a channel must be there, a missing test.dat played by
+// the others only gets a warning.
+func TestCheckMedia(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sim-media")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "ch.h264")
+	// sps, pps and an idr slice
+	es := []byte{0, 0, 0, 1, 0x67, 0x42, 0, 0x1e, 0, 0, 0, 1, 0x68, 0xce, 0, 0, 0, 1, 0x65, 0x88, 0x84}
+	if err := ioutil.WriteFile(file, es, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(defaultMediaFile); err == nil {
+		t.Skip(defaultMediaFile, " is in the package directory")
+	}
+
+	tests := []struct {
+		name  string
+		media []config.MediaConfig
+		ok    bool
+	}{
+		{"no channels", nil, true},
+		{"file", []config.MediaConfig{{File: file}}, true},
+		{"missing file", []config.MediaConfig{{File: filepath.Join(dir, "none.h264")}}, false},
+		{"missing default file", []config.MediaConfig{{File: file}, {}}, true},
+		{"missing default file and missing file", []config.MediaConfig{{}, {File: filepath.Join(dir, "none.h264")}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{}
+			for _, m := range tt.media {
+				cfg.Devices = append(cfg.Devices, config.DeviceInfo{DeviceID: "34020000001320000001", Media: m})
+			}
+			if err := CheckMedia(cfg); (err == nil) != tt.ok {
+				t.Errorf("err = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+// A session stopped while waiting for the next frame returns at once without
+// sending it.
+func TestSendFrameStop(t *testing.T) {
+	s := &session{stop: make(chan struct{}), start: time.Now()}
+	close(s.stop)
+	done := make(chan bool)
+	go func() { done <- s.sendFrame(&media.Frame{Time: time.Hour}) }()
+	select {
+	case hangup := <-done:
+		if hangup {
+			t.Error("sendFrame = true, want false for a stopped session")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("sendFrame waited for the frame after stop")
+	}
+}
+
+// The PSM of a source lists the codec's stream type.
+func TestStreamTypes(t *testing.T) {
+	tests := []struct {
+		codec string
+		want  int
+	}{
+		{media.CodecH264, 0x1b},
+		{media.CodecH265, 0x24},
+		{media.CodecG711A, 0x90},
+		{media.CodecG711U, 0x91},
+		{media.CodecAAC, 0x0f},
+		// the source lacks the stream
+		{"", 0},
+	}
+	for _, tt := range tests {
+		if got := streamTypes[tt.codec]; got != tt.want {
+			t.Errorf("stream type of %q = %#x, want %#x", tt.codec, got, tt.want)
+		}
+	}
+}
+
+func TestFormatLine(t *testing.T) {
+	tests := []struct {
+		video, audio string
+		want         string
+	}{
+		{media.CodecH264, "", "v/2////a///"},
+		{media.CodecH265, "", "v/5////a///"},
+		{media.CodecH264, media.CodecG711A, "v/2////a/1//"},
+		{media.CodecH265, media.CodecG711U, "v/5////a/1//"},
+		// no GB28181 code for AAC
+		{media.CodecH264, media.CodecAAC, "v/2////a///"},
+		{"", media.CodecG711A, "v/////a/1//"},
+	}
+	for _, tt := range tests {
+		if got := formatLine(tt.video, tt.audio); got != tt.want {
+			t.Errorf("formatLine(%q, %q) = %s, want %s", tt.video, tt.audio, got, tt.want)
+		}
+	}
+}
+
+// startPlatform listens for what the device sends on a local udp port.
+func startPlatform(t *testing.T) (*net.UDPConn, func() *sip.Msg) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, func() *sip.Msg {
+		buf := make([]byte, 65535)
+		conn.SetReadDeadline(time.Now().Add(time.Second * 2))
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, err := sip.ParseMsg(buf[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+}
+
+func inviteMsg(t *testing.T, callID, chid, m string) *sip.Msg {
+	body := "v=0\r\n" +
+		"o=" + chid + " 0 0 IN IP4 127.0.0.1\r\n" +
+		"s=Play\r\n" +
+		"c=IN IP4 127.0.0.1\r\n" +
+		"t=0 0\r\n" +
+		m +
+		"a=recvonly\r\n" +
+		"y=0100000001\r\n"
+	req := "INVITE sip:" + chid + "@3402000000 SIP/2.0\r\n" +
+		"Via: SIP/2.0/UDP 127.0.0.1:5060;branch=z9hG4bK" + callID + "\r\n" +
+		"From: <sip:34020000002000000001@3402000000>;tag=platform\r\n" +
+		"To: <sip:" + chid + "@3402000000>\r\n" +
+		"Call-ID: " + callID + "\r\n" +
+		"CSeq: 1 INVITE\r\n" +
+		"Content-Type: APPLICATION/SDP\r\n" +
+		"Content-Length: " + strconv.Itoa(len(body)) + "\r\n\r\n" + body
+	msg, err := sip.ParseMsg([]byte(req))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+// The answer reuses the payload type the platform offered for PS and
+// describes the source in its f= line.
+func TestInviteAnswer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sim-invite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	h264 := filepath.Join(dir, "ch.h264")
+	es := []byte{0, 0, 0, 1, 0x67, 0x42, 0, 0x1e, 0, 0, 0, 1, 0x68, 0xce, 0, 0, 0, 1, 0x65, 0x88, 0x84}
+	if err := ioutil.WriteFile(h264, es, 0600); err != nil {
+		t.Fatal(err)
+	}
+	h265 := filepath.Join(dir, "ch.h265")
+	// vps, sps, pps and an idr slice
+	es = []byte{0, 0, 0, 1, 0x40, 0x01, 0, 0, 0, 1, 0x42, 0x01, 0, 0, 0, 1, 0x44, 0x01, 0, 0, 0, 1, 0x26, 0x01, 0x80}
+	if err := ioutil.WriteFile(h265, es, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		file  string
+		m     string
+		code  int
+		pt    uint8
+		fline string
+	}{
+		{"ps 96", h264, "m=video 30000 RTP/AVP 96 98\r\na=rtpmap:96 PS/90000\r\na=rtpmap:98 H264/90000\r\n", 200, 96, "v/2////a///"},
+		{"ps 100", h265, "m=video 30000 RTP/AVP 98 100\r\na=rtpmap:98 H264/90000\r\na=rtpmap:100 PS/90000\r\n", 200, 100, "v/5////a///"},
+		{"no ps", h264, "m=video 30000 RTP/AVP 98\r\na=rtpmap:98 H264/90000\r\n", statusNotAcceptable, 0, ""},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			platform, recv := startPlatform(t)
+			defer platform.Close()
+			chid := "34020000001320000001"
+			cfg := &config.Config{
+				GBID:    "34020000001110000001",
+				Devices: []config.DeviceInfo{{DeviceID: chid, Media: config.MediaConfig{File: tt.file}}},
+			}
+			tr, err := transport.StartSip(xlog.New("invite"), platform.LocalAddr().String(), "udp", cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer tr.Close()
+			inv := NewInvite(cfg, func() []config.DeviceInfo { return cfg.Devices })
+			defer inv.Close(xlog.New("invite"), tr)
+
+			inv.InviteMsg(xlog.New("invite"), tr, inviteMsg(t, "invite-"+strconv.Itoa(i), chid, tt.m))
+			resp := recv()
+			if resp.Status != tt.code {
+				t.Fatalf("status %d, want %d", resp.Status, tt.code)
+			}
+			if tt.code != 200 {
+				return
+			}
+			answer, err := sdp.Parse(string(resp.Payload.Data()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if answer.Video == nil || len(answer.Video.Codecs) != 1 {
+				t.Fatalf("answer media %+v, want ps alone", answer.Video)
+			}
+			if c := answer.Video.Codecs[0]; c.PT != tt.pt || c.Name != "PS" || c.Rate != 90000 {
+				t.Errorf("answer codec %d %s/%d, want %d PS/90000", c.PT, c.Name, c.Rate, tt.pt)
+			}
+			fline := ""
+			for _, o := range answer.Other {
+				if o[0] == "f" {
+					fline = o[1]
+				}
+			}
+			if fline != tt.fline {
+				t.Errorf("f=%s, want %s", fline, tt.fline)
+			}
+		})
+	}
+}
+
+// Frames go out when due from the first one, a late frame doesn't shift the
+// ones after it.
+func TestSendFramePacing(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	rtp := packet.NewRRtpTransfer("", packet.UDPTransfer, 1)
+	if err := rtp.Service("127.0.0.1", "127.0.0.1", 0, conn.LocalAddr().(*net.UDPAddr).Port); err != nil {
+		t.Fatal(err)
+	}
+	defer rtp.Exit()
+	s := &session{stop: make(chan struct{}), rtp: rtp}
+
+	const slack = time.Millisecond * 30
+	var start time.Time
+	for i := 0; i < 6; i++ {
+		f := &media.Frame{Codec: media.CodecPS, Data: []byte{0, 0, 1, 0xba}, Time: time.Duration(i) * time.Millisecond * 40}
+		if i == 2 {
+			// the source was slow, frame 2 is late
+			time.Sleep(time.Millisecond * 70)
+		}
+		if s.sendFrame(f) {
+			t.Fatalf("transfer stopped at frame %d", i)
+		}
+		if i == 0 {
+			start = time.Now()
+		}
+		elapsed := time.Since(start)
+		if i == 2 {
+			// sent right away, 30ms after it was due
+			if elapsed < f.Time+slack-time.Millisecond*5 {
+				t.Errorf("late frame sent after %v", elapsed)
+			}
+			continue
+		}
+		if elapsed < f.Time || elapsed > f.Time+slack {
+			t.Errorf("frame %d due at %v sent after %v", i, f.Time, elapsed)
+		}
+	}
+}
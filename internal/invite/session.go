@@ -0,0 +1,188 @@
+package invite
+
+import (
+	"io"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/jart/gosip/sdp"
+	"github.com/jart/gosip/sip"
+	"github.com/lzh2nix/gb28181Simulator/internal/config"
+	"github.com/lzh2nix/gb28181Simulator/internal/media"
+	"github.com/lzh2nix/gb28181Simulator/internal/stats"
+	"github.com/lzh2nix/gb28181Simulator/internal/streams/packet"
+	"github.com/qiniu/x/xlog"
+)
+
+// PSM stream types of the codecs muxed into ps
+var streamTypes = map[string]int{
+	media.CodecH264:  packet.StreamTypeH264,
+	media.CodecH265:  packet.StreamTypeH265,
+	media.CodecG711A: packet.StreamTypeG711A,
+	media.CodecG711U: packet.StreamTypeG711U,
+	media.CodecAAC:   packet.StreamTypeAAC,
+}
+
+// session is one INVITE dialog with its own media pipeline: media reader,
+// timestamp clock and rtp transfer.
+type session struct {
+	state  int32
+	req    *sip.Msg
+	leg    *Leg
+	remote *sdpRemoteInfo
+	sdp    *sdp.SDP
+	// the channel in the INVITE Request-URI and what it plays
+	channel string
+	media   config.MediaConfig
+	// codecs of the media, told in the answer's f= line
+	video, audio string
+	// closed when the session ends, stops the media routine
+	stop chan struct{}
+
+	// owned by the media routine
+	rtp *packet.RtpTransfer
+	// when the INVITE arrived, zero once the first rtp packet went out
+	invitedAt time.Time
+	// when the first frame went out, each frame is due its time later
+	start time.Time
+}
+
+// setState moves the session to state, keeping the active sessions gauge
+// in step with the confirmed state.
+func (s *session) setState(state int32) {
+	old := atomic.SwapInt32(&s.state, state)
+	if old != confirmed && state == confirmed {
+		stats.AddGauge(stats.ActiveSessions, 1)
+	} else if old == confirmed && state != confirmed {
+		stats.AddGauge(stats.ActiveSessions, -1)
+	}
+}
+
+func (s *session) info() SessionInfo {
+	name := "completed"
+	if atomic.LoadInt32(&s.state) == confirmed {
+		name = "confirmed"
+	}
+	return SessionInfo{
+		CallID:    s.leg.callID,
+		Channel:   s.channel,
+		State:     name,
+		Remote:    s.remote.addr(),
+		Transport: s.remote.proto,
+		Media:     s.media.File,
+	}
+}
+
+// sendRTPPacket streams the media until the session ends. It reports true
+// when the device should hang up: a non-looping source was sent completely
+// or the media or the rtp transfer failed.
+func (s *session) sendRTPPacket(xlog *xlog.Logger) bool {
+	var rtp *packet.RtpTransfer
+	if s.remote.proto == "UDP" {
+		log.Println("new rtp transfer over udp, ip:", s.remote.ip, "port:", s.remote.port, "ssrc:", s.remote.ssrc)
+		rtp = packet.NewRRtpTransfer("", packet.UDPTransfer, s.remote.ssrc)
+	} else {
+		log.Println("new rtp transfer over tcp, ssrc:", s.remote.ssrc, "callid:", s.leg.callID)
+		rtp = packet.NewRRtpTransfer("", packet.TCPTransferActive, s.remote.ssrc)
+	}
+	// send ip,port and recv ip,port
+	err := rtp.Service(s.remote.lip, s.remote.ip, s.remote.lPort, s.remote.port)
+	if err != nil {
+		xlog.Info("connect failed, err = ", err)
+		return true
+	}
+	s.rtp = rtp
+	r, err := media.Open(s.media)
+	if err != nil {
+		xlog.Errorf("open media error(%v)", err)
+		rtp.Exit()
+		return true
+	}
+	video, audio := r.Codecs()
+	rtp.SetStreams(streamTypes[video], streamTypes[audio])
+	rtp.SetPayloadType(s.remote.pt)
+
+	defer func() {
+		log.Println("exit send rtp pkt routine callid:", s.leg.callID, "ssrc:", s.remote.ssrc)
+		r.Close()
+		rtp.Exit()
+	}()
+
+	for {
+		select {
+		case <-s.stop:
+			log.Println("got signal stop exit")
+			return false
+		default:
+		}
+		f, err := r.Read()
+		if err == io.EOF {
+			log.Println("media end, callid:", s.leg.callID)
+			return true
+		}
+		if err != nil {
+			xlog.Errorf("read media error(%v)", err)
+			return true
+		}
+		if s.sendFrame(f) {
+			log.Println("rtp transfer stopped, callid:", s.leg.callID)
+			return true
+		}
+	}
+}
+
+func (s *session) sendTalkRTPPacket(xlog *xlog.Logger) {
+	log.Println("new rtp talk transfer over tcp, ssrc:", s.remote.ssrc, "callid:", s.leg.callID)
+	rtp := packet.NewRRtpTransfer("", packet.TCPTransferActive, s.remote.ssrc)
+	err := rtp.Service(s.remote.lip, s.remote.ip, s.remote.lPort, s.remote.port)
+	if err != nil {
+		xlog.Info("connect failed, err = ", err)
+		return
+	}
+	s.rtp = rtp
+	log.Println("start send rtp talk pkt")
+	rtp.SendTalkRtp()
+	<-s.stop
+	rtp.Exit()
+}
+
+// sendFrame waits until f is due and sends it, it reports true once the rtp
+// transfer has stopped. Deadlines are kept on the monotonic clock from the
+// first frame, a frame sent late doesn't delay the ones after it. When the
+// session stops during the wait f is dropped and the media routine exits on
+// s.stop.
+func (s *session) sendFrame(f *media.Frame) bool {
+	if s.start.IsZero() {
+		s.start = time.Now()
+	}
+	if d := time.Until(s.start.Add(f.Time)); d > 0 {
+		due := time.NewTimer(d)
+		select {
+		case <-due.C:
+		case <-s.stop:
+			due.Stop()
+			return false
+		}
+	}
+	dts := packet.Timestamp(f.Time)
+	var stop bool
+	switch {
+	case f.Codec == media.CodecPS:
+		stop = s.rtp.SendPSdata(f.Data, f.Key, dts)
+	case f.Audio():
+		stop = s.rtp.SendAudio(f.Data, dts)
+	default:
+		// raw frames are muxed into ps on the fly
+		pts := packet.Timestamp(f.Time + f.CompositionTime)
+		stop = s.rtp.Send2data(f.Data, f.Key, pts, dts)
+	}
+	if stop {
+		return true
+	}
+	if !s.invitedAt.IsZero() {
+		stats.Observe(stats.InviteToRTP, time.Since(s.invitedAt))
+		s.invitedAt = time.Time{}
+	}
+	return false
+}
@@ -0,0 +1,176 @@
+package media
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/nareix/joy4/codec/aacparser"
+)
+
+// g711 is sent in frames of 20ms at 8kHz, a byte per sample
+const (
+	g711FrameSize     = 160
+	g711FrameDuration = time.Millisecond * 20
+)
+
+// g711Reader reads a headerless G.711 A-law or u-law file.
+type g711Reader struct {
+	f     *os.File
+	codec string
+	n     int
+}
+
+func openG711(file, codec string) (*g711Reader, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	if fi, err := f.Stat(); err != nil || fi.Size() == 0 {
+		f.Close()
+		if err == nil {
+			err = ErrEmpty
+		}
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	return &g711Reader{f: f, codec: codec}, nil
+}
+
+func (r *g711Reader) Read() (*Frame, error) {
+	buf := make([]byte, g711FrameSize)
+	n, err := io.ReadFull(r.f, buf)
+	if n == 0 {
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		return nil, err
+	}
+	f := &Frame{Codec: r.codec, Data: buf[:n], Time: time.Duration(r.n) * g711FrameDuration}
+	r.n++
+	return f, nil
+}
+
+func (r *g711Reader) Codecs() (video, audio string) {
+	return "", r.codec
+}
+
+func (r *g711Reader) Close() error {
+	return r.f.Close()
+}
+
+// adtsReader reads an AAC file of ADTS frames, each frame keeps its header.
+type adtsReader struct {
+	f *os.File
+	r *bufio.Reader
+	// time of the next frame
+	next time.Duration
+}
+
+func openADTS(file string) (*adtsReader, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	r := &adtsReader{f: f, r: bufio.NewReader(f)}
+	if _, _, _, err := r.header(); err != nil {
+		f.Close()
+		if err == io.EOF {
+			err = ErrNoADTS
+		}
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	return r, nil
+}
+
+// header parses the header of the next frame without consuming it.
+func (r *adtsReader) header() (cfg aacparser.MPEG4AudioConfig, framelen, samples int, err error) {
+	h, err := r.r.Peek(aacparser.ADTSHeaderLength)
+	if err != nil {
+		// io.EOF, also for a few bytes left at the end
+		return
+	}
+	if cfg, _, framelen, samples, err = aacparser.ParseADTSHeader(h); err != nil || cfg.SampleRate == 0 {
+		err = ErrNoADTS
+	}
+	return
+}
+
+func (r *adtsReader) Read() (*Frame, error) {
+	cfg, framelen, samples, err := r.header()
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, framelen)
+	if _, err := io.ReadFull(r.r, buf); err != nil {
+		// a frame cut off at the end of the file
+		return nil, io.EOF
+	}
+	f := &Frame{Codec: CodecAAC, Data: buf, Time: r.next}
+	r.next += time.Duration(samples) * time.Second / time.Duration(cfg.SampleRate)
+	return f, nil
+}
+
+func (r *adtsReader) Codecs() (video, audio string) {
+	return "", CodecAAC
+}
+
+func (r *adtsReader) Close() error {
+	return r.f.Close()
+}
+
+// adtsFrame puts an ADTS header in front of a raw AAC frame of a container.
+func adtsFrame(cfg aacparser.MPEG4AudioConfig, raw []byte) []byte {
+	b := make([]byte, aacparser.ADTSHeaderLength+len(raw))
+	aacparser.FillADTSHeader(b, cfg, 1024, len(raw))
+	copy(b[aacparser.ADTSHeaderLength:], raw)
+	return b
+}
+
+// mixReader interleaves the frames of a video and an audio source by time.
+type mixReader struct {
+	video Reader
+	audio Reader
+	// next frame of each, nil once the source has ended
+	v, a       *Frame
+	vEOF, aEOF bool
+}
+
+func (m *mixReader) Read() (*Frame, error) {
+	var err error
+	if m.v == nil && !m.vEOF {
+		if m.v, err = m.video.Read(); err == io.EOF {
+			m.vEOF = true
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	if m.a == nil && !m.aEOF {
+		if m.a, err = m.audio.Read(); err == io.EOF {
+			m.aEOF = true
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	var f *Frame
+	if m.v != nil && (m.a == nil || m.v.Time <= m.a.Time) {
+		f, m.v = m.v, nil
+	} else if m.a != nil {
+		f, m.a = m.a, nil
+	} else {
+		return nil, io.EOF
+	}
+	return f, nil
+}
+
+func (m *mixReader) Codecs() (video, audio string) {
+	video, _ = m.video.Codecs()
+	_, audio = m.audio.Codecs()
+	return video, audio
+}
+
+func (m *mixReader) Close() error {
+	m.audio.Close()
+	return m.video.Close()
+}
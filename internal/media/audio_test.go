@@ -0,0 +1,196 @@
+package media
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nareix/joy4/codec/aacparser"
+)
+
+// AAC LC, 8kHz mono: a frame of 1024 samples lasts 128ms
+var aacConfig = aacparser.MPEG4AudioConfig{ObjectType: aacparser.AOT_AAC_LC, SampleRateIndex: 11, ChannelConfig: 1}
+
+func writeTemp(t *testing.T, dir, name string, data []byte) string {
+	file := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(file, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestG711Reader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sim-audio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	data := make([]byte, 2*g711FrameSize+80)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	r, err := openG711(writeTemp(t, dir, "a.pcmu", data), CodecG711U)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	// the last frame is cut short
+	for i, size := range []int{g711FrameSize, g711FrameSize, 80} {
+		f, err := r.Read()
+		if err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+		if want := data[i*g711FrameSize : i*g711FrameSize+size]; !bytes.Equal(f.Data, want) {
+			t.Errorf("frame %d: %d bytes, want %d", i, len(f.Data), size)
+		}
+		if f.Codec != CodecG711U || !f.Audio() {
+			t.Errorf("frame %d codec %s", i, f.Codec)
+		}
+		if d := time.Duration(i) * time.Millisecond * 20; f.Time != d {
+			t.Errorf("frame %d time = %v, want %v", i, f.Time, d)
+		}
+	}
+	if f, err := r.Read(); err != io.EOF {
+		t.Errorf("got %v, %v after the last frame, want EOF", f, err)
+	}
+
+	if _, err := openG711(writeTemp(t, dir, "empty.pcma", nil), CodecG711A); !errors.Is(err, ErrEmpty) {
+		t.Errorf("empty file: err = %v, want %v", err, ErrEmpty)
+	}
+}
+
+func TestADTSReader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sim-audio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	raws := [][]byte{{1, 2, 3}, {4, 5}, {6}}
+	var data []byte
+	for _, raw := range raws {
+		data = append(data, adtsFrame(aacConfig, raw)...)
+	}
+	// a frame cut off at the end of the file
+	cut := adtsFrame(aacConfig, []byte{7, 8, 9})
+	data = append(data, cut[:len(cut)-1]...)
+
+	r, err := openADTS(writeTemp(t, dir, "a.aac", data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	for i, raw := range raws {
+		f, err := r.Read()
+		if err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+		if want := adtsFrame(aacConfig, raw); !bytes.Equal(f.Data, want) {
+			t.Errorf("frame %d = % x, want % x", i, f.Data, want)
+		}
+		if d := time.Duration(i) * time.Millisecond * 128; f.Time != d {
+			t.Errorf("frame %d time = %v, want %v", i, f.Time, d)
+		}
+	}
+	if f, err := r.Read(); err != io.EOF {
+		t.Errorf("got %v, %v after the last frame, want EOF", f, err)
+	}
+
+	for name, data := range map[string][]byte{"empty.aac": nil, "garbage.aac": []byte("not an adts frame")} {
+		if _, err := openADTS(writeTemp(t, dir, name, data)); !errors.Is(err, ErrNoADTS) {
+			t.Errorf("%s: err = %v, want %v", name, err, ErrNoADTS)
+		}
+	}
+}
+
+// frameReader hands out frames at the given times, then err.
+type frameReader struct {
+	codec string
+	times []time.Duration
+	err   error
+}
+
+func (r *frameReader) Read() (*Frame, error) {
+	if len(r.times) == 0 {
+		return nil, r.err
+	}
+	f := &Frame{Codec: r.codec, Time: r.times[0]}
+	r.times = r.times[1:]
+	return f, nil
+}
+
+func (r *frameReader) Codecs() (video, audio string) {
+	if r.codec == CodecH264 {
+		return r.codec, ""
+	}
+	return "", r.codec
+}
+
+func (r *frameReader) Close() error { return nil }
+
+func ms(n ...int) []time.Duration {
+	var d []time.Duration
+	for _, n := range n {
+		d = append(d, time.Duration(n)*time.Millisecond)
+	}
+	return d
+}
+
+func TestMixReader(t *testing.T) {
+	errBroken := errors.New("broken file")
+	tests := []struct {
+		name         string
+		video, audio []time.Duration
+		audioErr     error
+		// codec of each frame, v or a
+		want string
+		err  error
+	}{
+		{"interleaved", ms(0, 40, 80), ms(0, 20, 40, 60, 80, 100), io.EOF, "vaavaavaa", io.EOF},
+		{"video first on a tie", ms(0), ms(0), io.EOF, "va", io.EOF},
+		{"audio ends first", ms(0, 40, 80, 120), ms(0, 20), io.EOF, "vaavvv", io.EOF},
+		{"video ends first", ms(0), ms(0, 20, 40), io.EOF, "vaaa", io.EOF},
+		{"no audio", ms(0, 40), nil, io.EOF, "vv", io.EOF},
+		{"audio error", ms(0, 40), ms(0), errBroken, "va", errBroken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &mixReader{
+				video: &frameReader{codec: CodecH264, times: tt.video, err: io.EOF},
+				audio: &frameReader{codec: CodecG711A, times: tt.audio, err: tt.audioErr},
+			}
+			if v, a := m.Codecs(); v != CodecH264 || a != CodecG711A {
+				t.Errorf("codecs %s, %s", v, a)
+			}
+			var got []byte
+			var last time.Duration
+			for {
+				f, err := m.Read()
+				if err != nil {
+					if err != tt.err {
+						t.Errorf("err = %v, want %v", err, tt.err)
+					}
+					break
+				}
+				if f.Time < last {
+					t.Errorf("frame at %v after %v", f.Time, last)
+				}
+				last = f.Time
+				if f.Audio() {
+					got = append(got, 'a')
+				} else {
+					got = append(got, 'v')
+				}
+			}
+			if string(got) != tt.want {
+				t.Errorf("frames %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
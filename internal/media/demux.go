@@ -0,0 +1,160 @@
+package media
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/lzh2nix/gb28181Simulator/internal/config"
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/av/avutil"
+	"github.com/nareix/joy4/codec/aacparser"
+	"github.com/nareix/joy4/codec/h264parser"
+	"github.com/nareix/joy4/format"
+)
+
+var ErrNoVideo = errors.New("no h264 video in file")
+
+func init() {
+	format.RegisterAll()
+}
+
+// demuxReader reads the h264 video and the AAC audio of an MP4, FLV or
+// MPEG-TS file with the joy4 demuxers. Video packets are AVCC, they are
+// turned into Annex-B access units and key frames, those flagged by the
+// container or holding an IDR slice, get the parameter sets of the container
+// in front. Audio frames get an ADTS header.
+type demuxReader struct {
+	d     av.DemuxCloser
+	video int8
+	sps   []byte
+	pps   []byte
+	// -1 without audio
+	audio int8
+	aac   aacparser.MPEG4AudioConfig
+	// decode time of the first packet, frame times start at 0
+	start time.Duration
+	n     int
+	// next packet, read ahead to join the slices of one picture
+	pending *av.Packet
+	// error of the read ahead, returned once the frame before it is
+	pendingErr error
+}
+
+// openDemux opens c.File, with withAudio its AAC track is read as well.
+func openDemux(c config.MediaConfig, withAudio bool) (*demuxReader, error) {
+	d, err := avutil.Open(c.File)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", c.File, err)
+	}
+	streams, err := d.Streams()
+	if err != nil {
+		d.Close()
+		return nil, fmt.Errorf("%s: %w", c.File, err)
+	}
+	r := &demuxReader{d: d, video: -1, audio: -1}
+	for i, s := range streams {
+		switch s := s.(type) {
+		case h264parser.CodecData:
+			if r.video < 0 {
+				r.video, r.sps, r.pps = int8(i), s.SPS(), s.PPS()
+			}
+		case aacparser.CodecData:
+			if withAudio && r.audio < 0 {
+				r.audio, r.aac = int8(i), s.Config
+			}
+		}
+	}
+	if r.video < 0 {
+		d.Close()
+		return nil, fmt.Errorf("%s: %w", c.File, ErrNoVideo)
+	}
+	return r, nil
+}
+
+// packet returns the next video or audio packet.
+func (r *demuxReader) packet() (*av.Packet, error) {
+	if p := r.pending; p != nil {
+		r.pending = nil
+		return p, nil
+	}
+	if err := r.pendingErr; err != nil {
+		r.pendingErr = nil
+		return nil, err
+	}
+	for {
+		p, err := r.d.ReadPacket()
+		if err != nil {
+			return nil, err
+		}
+		if p.Idx == r.video || p.Idx == r.audio {
+			return &p, nil
+		}
+	}
+}
+
+func (r *demuxReader) Read() (*Frame, error) {
+	p, err := r.packet()
+	if err != nil {
+		return nil, err
+	}
+	if r.n == 0 {
+		r.start = p.Time
+	}
+	r.n++
+	if p.Idx == r.audio {
+		return &Frame{Codec: CodecAAC, Data: adtsFrame(r.aac, p.Data), Time: p.Time - r.start}, nil
+	}
+	f := &Frame{
+		Codec:           CodecH264,
+		Key:             p.IsKeyFrame,
+		Time:            p.Time - r.start,
+		CompositionTime: p.CompositionTime,
+	}
+	hasSPS := false
+	for {
+		nalus, _ := h264parser.SplitNALUs(p.Data)
+		for _, nal := range nalus {
+			if len(nal) == 0 {
+				continue
+			}
+			switch h264Type(nal) {
+			case 5:
+				// not every container flags its key frames
+				f.Key = true
+			case 7:
+				hasSPS = true
+			}
+			f.Data = appendNAL(f.Data, nal)
+		}
+		// the ts demuxer hands out every slice as a packet of its own
+		next, err := r.packet()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			r.pendingErr = err
+			break
+		}
+		if next.Idx != r.video || next.Time != p.Time {
+			r.pending = next
+			break
+		}
+		p = next
+	}
+	if f.Key && !hasSPS {
+		f.Data = append(appendNAL(appendNAL(nil, r.sps), r.pps), f.Data...)
+	}
+	return f, nil
+}
+
+func (r *demuxReader) Codecs() (video, audio string) {
+	if r.audio < 0 {
+		return CodecH264, ""
+	}
+	return CodecH264, CodecAAC
+}
+
+func (r *demuxReader) Close() error {
+	return r.d.Close()
+}
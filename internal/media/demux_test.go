@@ -0,0 +1,104 @@
+package media
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/nareix/joy4/av"
+)
+
+// fakeDemuxer hands out packets, then err.
+type fakeDemuxer struct {
+	packets []av.Packet
+	err     error
+}
+
+func (d *fakeDemuxer) Streams() ([]av.CodecData, error) { return nil, nil }
+func (d *fakeDemuxer) Close() error                     { return nil }
+
+func (d *fakeDemuxer) ReadPacket() (av.Packet, error) {
+	if len(d.packets) == 0 {
+		return av.Packet{}, d.err
+	}
+	p := d.packets[0]
+	d.packets = d.packets[1:]
+	return p, nil
+}
+
+// avcc writes nals with 4 byte lengths, as mp4 and flv carry them.
+func avcc(nals ...[]byte) []byte {
+	var b []byte
+	for _, nal := range nals {
+		n := len(nal)
+		b = append(b, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+		b = append(b, nal...)
+	}
+	return b
+}
+
+func videoPacket(key bool, ms int, nals ...[]byte) av.Packet {
+	return av.Packet{IsKeyFrame: key, Time: time.Duration(ms) * time.Millisecond, Data: avcc(nals...)}
+}
+
+func TestDemuxReader(t *testing.T) {
+	errBroken := errors.New("broken file")
+	tests := []struct {
+		name    string
+		packets []av.Packet
+		err     error
+		want    []wantFrame
+	}{
+		{"flagged key frame", []av.Packet{
+			videoPacket(true, 0, idr), videoPacket(false, 40, pFrame),
+		}, io.EOF, []wantFrame{
+			{[][]byte{sps, pps, idr}, true},
+			{[][]byte{pFrame}, false},
+		}},
+		{"unflagged idr", []av.Packet{
+			videoPacket(false, 0, idr), videoPacket(false, 40, pFrame),
+		}, io.EOF, []wantFrame{
+			{[][]byte{sps, pps, idr}, true},
+			{[][]byte{pFrame}, false},
+		}},
+		{"in-band parameter sets", []av.Packet{
+			videoPacket(false, 0, sps, pps, idr),
+		}, io.EOF, []wantFrame{
+			{[][]byte{sps, pps, idr}, true},
+		}},
+		{"slices of one picture", []av.Packet{
+			videoPacket(false, 0, idr), videoPacket(false, 0, idrSlice), videoPacket(false, 40, pFrame),
+		}, io.EOF, []wantFrame{
+			{[][]byte{sps, pps, idr, idrSlice}, true},
+			{[][]byte{pFrame}, false},
+		}},
+		{"error after a frame", []av.Packet{
+			videoPacket(true, 0, idr), videoPacket(false, 40, pFrame),
+		}, errBroken, []wantFrame{
+			{[][]byte{sps, pps, idr}, true},
+			{[][]byte{pFrame}, false},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &demuxReader{d: &fakeDemuxer{packets: tt.packets, err: tt.err}, sps: sps, pps: pps, audio: -1}
+			for i, want := range tt.want {
+				f, err := r.Read()
+				if err != nil {
+					t.Fatalf("frame %d: %v", i, err)
+				}
+				if data := annexB(false, want.nals...); !bytes.Equal(f.Data, data) {
+					t.Errorf("frame %d = % x, want % x", i, f.Data, data)
+				}
+				if f.Key != want.key {
+					t.Errorf("frame %d key = %v, want %v", i, f.Key, want.key)
+				}
+			}
+			if f, err := r.Read(); err != tt.err {
+				t.Errorf("got %v, %v after the last frame, want %v", f, err, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,246 @@
+package media
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/lzh2nix/gb28181Simulator/internal/config"
+)
+
+var startCode = []byte{0, 0, 0, 1}
+
+// NAL unit types of the parameter sets in the order they go in front of a
+// picture
+var (
+	// SPS, PPS
+	h264ParamSets = []byte{7, 8}
+	// VPS, SPS, PPS
+	h265ParamSets = []byte{32, 33, 34}
+)
+
+// esReader groups the NAL units of an Annex-B H.264 or H.265 file into access
+// units, one per frame.
+type esReader struct {
+	f        *os.File
+	nal      *nalReader
+	codec    string
+	interval time.Duration
+	// frames read so far
+	n int
+	// first NAL unit of the next access unit
+	pending []byte
+	// latest parameter sets by NAL unit type
+	params map[byte][]byte
+}
+
+func openES(c config.MediaConfig) (*esReader, error) {
+	f, err := os.Open(c.File)
+	if err != nil {
+		return nil, err
+	}
+	r := &esReader{
+		f:        f,
+		nal:      &nalReader{r: bufio.NewReader(f)},
+		codec:    c.Codec,
+		interval: time.Second / time.Duration(c.FrameRate),
+		params:   make(map[byte][]byte),
+	}
+	// skip whatever comes before the first start code
+	_, err = r.nal.next()
+	if err == io.EOF || err == nil && r.nal.eof {
+		err = ErrNoNAL
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", c.File, err)
+	}
+	return r, nil
+}
+
+func (r *esReader) Read() (*Frame, error) {
+	f := &Frame{Codec: r.codec}
+	vcl := false
+	// parameter sets in the access unit, a bit per NAL unit type
+	var have uint64
+	for {
+		nal := r.pending
+		r.pending = nil
+		if nal == nil {
+			var err error
+			if nal, err = r.nal.next(); err == io.EOF {
+				break
+			} else if err != nil {
+				return nil, err
+			}
+		}
+		if len(nal) == 0 {
+			continue
+		}
+		if vcl && r.startsAccessUnit(nal) {
+			r.pending = nal
+			break
+		}
+		if t := r.nalType(nal); r.isParamSet(t) {
+			r.params[t] = nal
+			have |= 1 << t
+		}
+		vcl = vcl || r.isVCL(nal)
+		f.Key = f.Key || r.isKey(nal)
+		f.Data = appendNAL(f.Data, nal)
+	}
+	if len(f.Data) == 0 {
+		return nil, io.EOF
+	}
+	if f.Key {
+		f.Data, f.Key = r.withParamSets(f.Data, have)
+	}
+	f.Time = time.Duration(r.n) * r.interval
+	r.n++
+	return f, nil
+}
+
+func (r *esReader) Codecs() (video, audio string) {
+	return r.codec, ""
+}
+
+func (r *esReader) Close() error {
+	return r.f.Close()
+}
+
+// withParamSets puts the parameter sets a key frame lacks in front of it,
+// the latest ones from earlier in the stream. A decoder can't start at a
+// frame without all of them, it is no key frame then.
+func (r *esReader) withParamSets(data []byte, have uint64) ([]byte, bool) {
+	var ps []byte
+	for _, t := range r.paramSets() {
+		if have&(1<<t) != 0 {
+			continue
+		}
+		nal, ok := r.params[t]
+		if !ok {
+			return data, false
+		}
+		ps = appendNAL(ps, nal)
+	}
+	return append(ps, data...), true
+}
+
+func (r *esReader) paramSets() []byte {
+	if r.codec == CodecH265 {
+		return h265ParamSets
+	}
+	return h264ParamSets
+}
+
+func (r *esReader) isParamSet(t byte) bool {
+	for _, p := range r.paramSets() {
+		if p == t {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *esReader) nalType(nal []byte) byte {
+	if r.codec == CodecH265 {
+		return h265Type(nal)
+	}
+	return h264Type(nal)
+}
+
+func (r *esReader) isVCL(nal []byte) bool {
+	if r.codec == CodecH265 {
+		return h265Type(nal) < 32
+	}
+	t := h264Type(nal)
+	return t >= 1 && t <= 5
+}
+
+// isKey tells whether nal is a slice of an IDR picture, for H.265 of an IRAP
+// picture.
+func (r *esReader) isKey(nal []byte) bool {
+	if r.codec == CodecH265 {
+		t := h265Type(nal)
+		return t >= 16 && t <= 23
+	}
+	return h264Type(nal) == 5
+}
+
+// startsAccessUnit tells whether nal, following a picture, belongs to the
+// next access unit: a parameter set, SEI or delimiter, or the first slice of
+// the next picture.
+func (r *esReader) startsAccessUnit(nal []byte) bool {
+	if r.codec == CodecH265 {
+		switch t := h265Type(nal); {
+		case t < 32:
+			// first_slice_segment_in_pic_flag
+			return len(nal) > 2 && nal[2]&0x80 != 0
+		case t <= 35, t == 39, t >= 41 && t <= 44, t >= 48 && t <= 55:
+			return true
+		}
+		return false
+	}
+	switch t := h264Type(nal); {
+	case t >= 1 && t <= 5:
+		// first_mb_in_slice is 0
+		return len(nal) > 1 && nal[1]&0x80 != 0
+	case t >= 6 && t <= 9, t >= 14 && t <= 18:
+		return true
+	}
+	return false
+}
+
+// appendNAL appends nal with a start code in front.
+func appendNAL(b, nal []byte) []byte {
+	return append(append(b, startCode...), nal...)
+}
+
+func h264Type(nal []byte) byte {
+	return nal[0] & 0x1f
+}
+
+func h265Type(nal []byte) byte {
+	return (nal[0] >> 1) & 0x3f
+}
+
+// nalReader splits an Annex-B byte stream at the start codes.
+type nalReader struct {
+	r   *bufio.Reader
+	eof bool
+}
+
+// next returns the bytes up to the next start code, or up to the end of the
+// stream, without the zero bytes in front of the start code.
+func (n *nalReader) next() ([]byte, error) {
+	if n.eof {
+		return nil, io.EOF
+	}
+	var buf []byte
+	for {
+		b, err := n.r.ReadByte()
+		if err == io.EOF {
+			n.eof = true
+			if buf = trimZeros(buf); len(buf) == 0 {
+				return nil, io.EOF
+			}
+			return buf, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		buf = append(buf, b)
+		if l := len(buf); b == 1 && l >= 3 && buf[l-2] == 0 && buf[l-3] == 0 {
+			return trimZeros(buf[:l-3]), nil
+		}
+	}
+}
+
+func trimZeros(b []byte) []byte {
+	for len(b) > 0 && b[len(b)-1] == 0 {
+		b = b[:len(b)-1]
+	}
+	return b
+}
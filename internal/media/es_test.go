@@ -0,0 +1,151 @@
+package media
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lzh2nix/gb28181Simulator/internal/config"
+)
+
+// NAL units, first byte the header, for H.265 the first two
+var (
+	sps      = []byte{0x67, 0x42}
+	pps      = []byte{0x68, 0xce}
+	idr      = []byte{0x65, 0x88} // first_mb_in_slice 0
+	idrSlice = []byte{0x65, 0x08}
+	pFrame   = []byte{0x41, 0x9a}
+	sei      = []byte{0x06, 0x05}
+	aud      = []byte{0x09, 0xf0}
+
+	vps265   = []byte{0x40, 0x01}
+	sps265   = []byte{0x42, 0x01}
+	pps265   = []byte{0x44, 0x01}
+	idr265   = []byte{0x26, 0x01, 0x80} // first_slice_segment_in_pic_flag
+	slice265 = []byte{0x26, 0x01, 0x40}
+	trail265 = []byte{0x02, 0x01, 0x80}
+)
+
+// annexB writes nals with 4 byte start codes, 3 byte ones with short.
+func annexB(short bool, nals ...[]byte) []byte {
+	var b []byte
+	for _, nal := range nals {
+		if short {
+			b = append(b, 0, 0, 1)
+		} else {
+			b = append(b, startCode...)
+		}
+		b = append(b, nal...)
+	}
+	return b
+}
+
+type wantFrame struct {
+	nals [][]byte
+	key  bool
+}
+
+func TestESReader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sim-es")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name   string
+		codec  string
+		stream []byte
+		want   []wantFrame
+	}{
+		{"idr and p frames", CodecH264, annexB(false, sps, pps, idr, pFrame, pFrame), []wantFrame{
+			{[][]byte{sps, pps, idr}, true},
+			{[][]byte{pFrame}, false},
+			{[][]byte{pFrame}, false},
+		}},
+		{"3 byte start codes", CodecH264, annexB(true, sps, pps, idr, pFrame), []wantFrame{
+			{[][]byte{sps, pps, idr}, true},
+			{[][]byte{pFrame}, false},
+		}},
+		{"slices of one picture", CodecH264, annexB(false, sps, pps, idr, idrSlice, pFrame), []wantFrame{
+			{[][]byte{sps, pps, idr, idrSlice}, true},
+			{[][]byte{pFrame}, false},
+		}},
+		{"sei and delimiter start the next frame", CodecH264, annexB(false, sps, pps, idr, aud, sei, pFrame), []wantFrame{
+			{[][]byte{sps, pps, idr}, true},
+			{[][]byte{aud, sei, pFrame}, false},
+		}},
+		{"later idr gets the parameter sets", CodecH264, annexB(false, sps, pps, idr, pFrame, idr), []wantFrame{
+			{[][]byte{sps, pps, idr}, true},
+			{[][]byte{pFrame}, false},
+			{[][]byte{sps, pps, idr}, true},
+		}},
+		{"idr without parameter sets", CodecH264, annexB(false, idr, pFrame), []wantFrame{
+			{[][]byte{idr}, false},
+			{[][]byte{pFrame}, false},
+		}},
+		{"garbage and trailing zeros", CodecH264, append(append([]byte{0xff, 0xfe}, annexB(false, sps, pps, idr)...), 0, 0), []wantFrame{
+			{[][]byte{sps, pps, idr}, true},
+		}},
+		{"h265", CodecH265, annexB(false, vps265, sps265, pps265, idr265, slice265, trail265), []wantFrame{
+			{[][]byte{vps265, sps265, pps265, idr265, slice265}, true},
+			{[][]byte{trail265}, false},
+		}},
+		{"h265 later irap gets the parameter sets", CodecH265, annexB(false, vps265, sps265, pps265, idr265, trail265, idr265), []wantFrame{
+			{[][]byte{vps265, sps265, pps265, idr265}, true},
+			{[][]byte{trail265}, false},
+			{[][]byte{vps265, sps265, pps265, idr265}, true},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(dir, "es")
+			if err := ioutil.WriteFile(file, tt.stream, 0600); err != nil {
+				t.Fatal(err)
+			}
+			r, err := openES(config.MediaConfig{File: file, Codec: tt.codec, FrameRate: 25})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+			for i, want := range tt.want {
+				f, err := r.Read()
+				if err != nil {
+					t.Fatalf("frame %d: %v", i, err)
+				}
+				if data := annexB(false, want.nals...); !bytes.Equal(f.Data, data) {
+					t.Errorf("frame %d = % x, want % x", i, f.Data, data)
+				}
+				if f.Key != want.key {
+					t.Errorf("frame %d key = %v, want %v", i, f.Key, want.key)
+				}
+				if d := time.Duration(i) * time.Second / 25; f.Time != d {
+					t.Errorf("frame %d time = %v, want %v", i, f.Time, d)
+				}
+			}
+			if f, err := r.Read(); err != io.EOF {
+				t.Errorf("got %v, %v after the last frame, want EOF", f, err)
+			}
+		})
+	}
+}
+
+func TestESReaderNoStartCode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sim-es")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "es")
+	if err := ioutil.WriteFile(file, []byte{0x67, 0x42, 0x65, 0x88}, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openES(config.MediaConfig{File: file, Codec: CodecH264, FrameRate: 25}); !errors.Is(err, ErrNoNAL) {
+		t.Fatalf("err = %v, want %v", err, ErrNoNAL)
+	}
+}
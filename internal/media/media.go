@@ -0,0 +1,249 @@
+// Package media reads the files channels stream and hands them out frame by
+// frame.
+package media
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/lzh2nix/gb28181Simulator/internal/config"
+)
+
+const (
+	CodecPS   = "ps"
+	CodecH264 = "h264"
+	CodecH265 = "h265"
+	// containers, demuxed with joy4
+	CodecMP4 = "mp4"
+	CodecFLV = "flv"
+	CodecTS  = "ts"
+	// audio
+	CodecG711A = "g711a"
+	CodecG711U = "g711u"
+	CodecAAC   = "aac"
+
+	DefaultFrameRate = 25
+)
+
+// codec of a file by its extension when none is configured
+var extCodecs = map[string]string{
+	".h264": CodecH264, ".264": CodecH264, ".avc": CodecH264,
+	".h265": CodecH265, ".265": CodecH265, ".hevc": CodecH265,
+	".mp4": CodecMP4, ".m4v": CodecMP4, ".mov": CodecMP4,
+	".flv": CodecFLV,
+	".ts":  CodecTS,
+}
+
+// codec of an audio file by its extension
+var extAudioCodecs = map[string]string{
+	".g711a": CodecG711A, ".alaw": CodecG711A, ".pcma": CodecG711A,
+	".g711u": CodecG711U, ".ulaw": CodecG711U, ".pcmu": CodecG711U,
+	".aac": CodecAAC,
+}
+
+var (
+	ErrUnknownCodec = errors.New("unknown codec")
+	ErrBadFrameRate = errors.New("frameRate must not be negative")
+	ErrEmpty        = errors.New("no frame in file")
+	ErrNoPack       = errors.New("no ps pack header in file")
+	ErrNoNAL        = errors.New("no annex-b start code in file")
+	ErrNoADTS       = errors.New("no adts header in file")
+	ErrPSAudio      = errors.New("a ps file is sent as is, it can't take an audio file")
+)
+
+// Frame is one unit of a source: a whole pack of a ps file, an access unit
+// of an elementary stream or container, its NAL units with Annex-B start
+// codes, or an audio frame, AAC with its ADTS header.
+type Frame struct {
+	// CodecPS for a pack that is sent as is, otherwise the video or audio
+	// codec of what is to be muxed
+	Codec string
+	Data  []byte
+	// a decoder can start here: a pack with a system header, an IDR or IRAP
+	// picture
+	Key bool
+	// decode time from the start of the source
+	Time time.Duration
+	// presentation minus decode time, for B-frames of a container
+	CompositionTime time.Duration
+}
+
+// Audio tells whether f is an audio frame.
+func (f *Frame) Audio() bool {
+	return f.Codec == CodecG711A || f.Codec == CodecG711U || f.Codec == CodecAAC
+}
+
+// Reader hands out the frames of a source in order and io.EOF after the last.
+type Reader interface {
+	Read() (*Frame, error)
+	// codecs of the video and the audio, empty for one the source lacks;
+	// the video of a ps file is the one in its PSM, CodecPS when unknown
+	Codecs() (video, audio string)
+	Close() error
+}
+
+// Open opens the source c describes. A looping source doesn't end, the frame
+// times keep counting up when it starts over.
+func Open(c config.MediaConfig) (Reader, error) {
+	c, err := normalize(c)
+	if err != nil {
+		return nil, err
+	}
+	r, err := open(c)
+	if err != nil {
+		return nil, err
+	}
+	if !c.Looping() {
+		return r, nil
+	}
+	l := &looper{c: c, r: r}
+	l.video, l.audio = r.Codecs()
+	return l, nil
+}
+
+// Codecs opens c to tell the codecs of its video and audio.
+func Codecs(c config.MediaConfig) (video, audio string, err error) {
+	c, err = normalize(c)
+	if err != nil {
+		return "", "", err
+	}
+	r, err := open(c)
+	if err != nil {
+		return "", "", err
+	}
+	defer r.Close()
+	video, audio = r.Codecs()
+	return video, audio, nil
+}
+
+// Check opens c and reads its first frame, so that a missing or broken file
+// is found before the first INVITE.
+func Check(c config.MediaConfig) error {
+	c, err := normalize(c)
+	if err != nil {
+		return err
+	}
+	r, err := open(c)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if _, err := r.Read(); err != nil {
+		if err == io.EOF {
+			err = ErrEmpty
+		}
+		return fmt.Errorf("%s: %w", c.File, err)
+	}
+	return nil
+}
+
+func normalize(c config.MediaConfig) (config.MediaConfig, error) {
+	c.Codec = strings.ToLower(c.Codec)
+	if c.Codec == "" {
+		c.Codec = extCodecs[strings.ToLower(filepath.Ext(c.File))]
+	}
+	if c.Codec == "" {
+		c.Codec = CodecPS
+	}
+	c.AudioCodec = strings.ToLower(c.AudioCodec)
+	if c.AudioCodec == "" {
+		c.AudioCodec = extAudioCodecs[strings.ToLower(filepath.Ext(c.AudioFile))]
+	}
+	if c.FrameRate < 0 {
+		return c, ErrBadFrameRate
+	}
+	if c.FrameRate == 0 {
+		c.FrameRate = DefaultFrameRate
+	}
+	return c, nil
+}
+
+func open(c config.MediaConfig) (Reader, error) {
+	if c.Codec == CodecPS && c.AudioFile != "" {
+		return nil, fmt.Errorf("%s: %w", c.File, ErrPSAudio)
+	}
+	video, err := openVideo(c)
+	if err != nil || c.AudioFile == "" {
+		return video, err
+	}
+	audio, err := openAudio(c)
+	if err != nil {
+		video.Close()
+		return nil, err
+	}
+	return &mixReader{video: video, audio: audio}, nil
+}
+
+func openVideo(c config.MediaConfig) (Reader, error) {
+	switch c.Codec {
+	case CodecPS:
+		return openPS(c)
+	case CodecH264, CodecH265:
+		return openES(c)
+	case CodecMP4, CodecFLV, CodecTS:
+		// the audio file replaces the audio of the container
+		return openDemux(c, c.AudioFile == "")
+	}
+	return nil, fmt.Errorf("%s: %w %q", c.File, ErrUnknownCodec, c.Codec)
+}
+
+func openAudio(c config.MediaConfig) (Reader, error) {
+	switch c.AudioCodec {
+	case CodecG711A, CodecG711U:
+		return openG711(c.AudioFile, c.AudioCodec)
+	case CodecAAC:
+		return openADTS(c.AudioFile)
+	}
+	return nil, fmt.Errorf("%s: %w %q", c.AudioFile, ErrUnknownCodec, c.AudioCodec)
+}
+
+// looper reopens the source at its end.
+type looper struct {
+	c config.MediaConfig
+	r Reader
+	// codecs of the source, r is nil when reopening failed
+	video, audio string
+	// added to the frame times of the current pass
+	offset time.Duration
+	// where the next pass starts, one frame after the last one
+	end time.Duration
+	// frames read in the current pass
+	n int
+}
+
+func (l *looper) Read() (*Frame, error) {
+	f, err := l.r.Read()
+	if err == io.EOF && l.n > 0 {
+		l.r.Close()
+		r, oerr := open(l.c)
+		if oerr != nil {
+			l.r = nil
+			return nil, oerr
+		}
+		l.r = r
+		l.offset, l.n = l.end, 0
+		f, err = l.r.Read()
+	}
+	if err != nil {
+		return nil, err
+	}
+	l.n++
+	f.Time += l.offset
+	l.end = f.Time + time.Second/time.Duration(l.c.FrameRate)
+	return f, nil
+}
+
+func (l *looper) Codecs() (video, audio string) {
+	return l.video, l.audio
+}
+
+func (l *looper) Close() error {
+	if l.r == nil {
+		return nil
+	}
+	return l.r.Close()
+}
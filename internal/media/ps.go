@@ -0,0 +1,156 @@
+package media
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/lzh2nix/gb28181Simulator/internal/config"
+	"github.com/lzh2nix/gb28181Simulator/internal/streams/packet"
+)
+
+// codecs of the PSM stream types
+var psmCodecs = map[byte]string{
+	packet.StreamTypeH264:  CodecH264,
+	packet.StreamTypeH265:  CodecH265,
+	packet.StreamTypeG711A: CodecG711A,
+	packet.StreamTypeG711U: CodecG711U,
+	packet.StreamTypeAAC:   CodecAAC,
+}
+
+// psReader splits a pre-muxed ps file at the pack start codes, each pack is
+// one frame.
+type psReader struct {
+	f        *os.File
+	r        *bufio.Reader
+	interval time.Duration
+	// packs read so far
+	n   int
+	eof bool
+	// first pack, read at open for the codecs in its PSM
+	first        *Frame
+	video, audio string
+}
+
+func openPS(c config.MediaConfig) (*psReader, error) {
+	f, err := os.Open(c.File)
+	if err != nil {
+		return nil, err
+	}
+	r := &psReader{f: f, r: bufio.NewReader(f), interval: time.Second / time.Duration(c.FrameRate)}
+	// skip whatever comes before the first pack
+	if _, err := r.next(); err != nil {
+		f.Close()
+		if err == io.EOF {
+			err = ErrNoPack
+		}
+		return nil, fmt.Errorf("%s: %w", c.File, err)
+	}
+	first, err := r.Read()
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", c.File, err)
+	}
+	r.first = first
+	r.video, r.audio = psmStreams(first.Data)
+	if r.video == "" {
+		r.video = CodecPS
+	}
+	return r, nil
+}
+
+// next reads up to and including the next pack start code and returns what
+// came before it, or the rest of the file with io.EOF.
+func (r *psReader) next() ([]byte, error) {
+	var buf []byte
+	for {
+		b, err := r.r.ReadByte()
+		if err != nil {
+			return buf, err
+		}
+		buf = append(buf, b)
+		if n := len(buf); n >= 4 && isPackStart(buf[n-4:]) {
+			return buf[:n-4], nil
+		}
+	}
+}
+
+func (r *psReader) Read() (*Frame, error) {
+	if f := r.first; f != nil {
+		r.first = nil
+		return f, nil
+	}
+	if r.eof {
+		return nil, io.EOF
+	}
+	body, err := r.next()
+	if err == io.EOF {
+		r.eof = true
+	} else if err != nil {
+		return nil, err
+	}
+	data := append([]byte{0, 0, 1, 0xba}, body...)
+	f := &Frame{Codec: CodecPS, Data: data, Key: hasSystemHeader(data), Time: time.Duration(r.n) * r.interval}
+	r.n++
+	return f, nil
+}
+
+// Codecs tells the codecs in the PSM of the first pack, the video is CodecPS
+// when the pack has no PSM or one with an unknown video stream type.
+func (r *psReader) Codecs() (video, audio string) {
+	return r.video, r.audio
+}
+
+func (r *psReader) Close() error {
+	return r.f.Close()
+}
+
+func isPackStart(b []byte) bool {
+	return b[0] == 0 && b[1] == 0 && b[2] == 1 && b[3] == 0xba
+}
+
+// hasSystemHeader tells whether the pack header is followed by a system
+// header, which encoders write in front of key frames.
+func hasSystemHeader(pack []byte) bool {
+	if len(pack) < 14 {
+		return false
+	}
+	// pack header and its stuffing bytes
+	n := 14 + int(pack[13]&0x07)
+	return len(pack) >= n+4 && pack[n] == 0 && pack[n+1] == 0 && pack[n+2] == 1 && pack[n+3] == 0xbb
+}
+
+// psmStreams looks up the codecs of the video and the audio stream in the
+// program stream map of a pack.
+func psmStreams(pack []byte) (video, audio string) {
+	i := bytes.Index(pack, []byte{0, 0, 1, 0xbc})
+	if i < 0 || len(pack) < i+10 {
+		return "", ""
+	}
+	psm := pack[i:]
+	// start code, length, version, marker, program_stream_info
+	n := 10 + int(binary.BigEndian.Uint16(psm[8:]))
+	if len(psm) < n+2 {
+		return "", ""
+	}
+	end := n + 2 + int(binary.BigEndian.Uint16(psm[n:]))
+	if end > len(psm) {
+		end = len(psm)
+	}
+	// stream_type, elementary_stream_id, elementary_stream_info_length
+	for i := n + 2; i+4 <= end; i += 4 + int(binary.BigEndian.Uint16(psm[i+2:])) {
+		c, ok := psmCodecs[psm[i]]
+		switch {
+		case !ok:
+		case psm[i+1]&0xf0 == 0xe0 && video == "":
+			video = c
+		case psm[i+1]&0xe0 == 0xc0 && audio == "":
+			audio = c
+		}
+	}
+	return video, audio
+}
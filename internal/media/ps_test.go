@@ -0,0 +1,46 @@
+package media
+
+import "testing"
+
+// psm builds a pack holding a program stream map of the given
+// stream_type/elementary_stream_id entries, each with info bytes of infoLen.
+func psm(infoLen int, entries ...[2]byte) []byte {
+	var m []byte
+	for _, e := range entries {
+		m = append(m, e[0], e[1], 0, byte(infoLen))
+		m = append(m, make([]byte, infoLen)...)
+	}
+	b := []byte{0, 0, 1, 0xba, 0x44, 0, 4, 0, 4, 1, 0, 0, 3, 0xf8}
+	b = append(b, 0, 0, 1, 0xbc, 0, byte(10+len(m)), 0xe0, 0xff)
+	// program_stream_info of 2 bytes
+	b = append(b, 0, 2, 0xaa, 0xbb)
+	b = append(b, 0, byte(len(m)))
+	b = append(b, m...)
+	return append(b, 0, 0, 0, 0)
+}
+
+func TestPSMStreams(t *testing.T) {
+	tests := []struct {
+		name         string
+		pack         []byte
+		video, audio string
+	}{
+		{"h264", psm(0, [2]byte{0x1b, 0xe0}), CodecH264, ""},
+		{"h265", psm(0, [2]byte{0x24, 0xe0}), CodecH265, ""},
+		{"h264 and g711a", psm(0, [2]byte{0x1b, 0xe0}, [2]byte{0x90, 0xc0}), CodecH264, CodecG711A},
+		{"h265 and g711u", psm(0, [2]byte{0x24, 0xe0}, [2]byte{0x91, 0xc0}), CodecH265, CodecG711U},
+		{"aac first", psm(0, [2]byte{0x0f, 0xc0}, [2]byte{0x1b, 0xe0}), CodecH264, CodecAAC},
+		{"stream info skipped", psm(3, [2]byte{0x24, 0xe0}, [2]byte{0x0f, 0xc0}), CodecH265, CodecAAC},
+		{"unknown types", psm(0, [2]byte{0x10, 0xe0}, [2]byte{0x92, 0xc0}, [2]byte{0x1b, 0xe1}), CodecH264, ""},
+		{"first of each kind", psm(0, [2]byte{0x24, 0xe0}, [2]byte{0x1b, 0xe1}), CodecH265, ""},
+		{"no psm", []byte{0, 0, 1, 0xba, 0x44, 0, 4, 0, 4, 1}, "", ""},
+		{"cut short", psm(0, [2]byte{0x1b, 0xe0})[:24], "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if video, audio := psmStreams(tt.pack); video != tt.video || audio != tt.audio {
+				t.Errorf("got %q, %q, want %q, %q", video, audio, tt.video, tt.audio)
+			}
+		})
+	}
+}
@@ -3,7 +3,6 @@ package reg
 import (
 	"encoding/xml"
 	"log"
-	"net"
 	"strconv"
 	"strings"
 	"sync/atomic"
@@ -12,6 +11,8 @@ import (
 	"github.com/jart/gosip/sip"
 	"github.com/jart/gosip/util"
 	"github.com/lzh2nix/gb28181Simulator/internal/config"
+	"github.com/lzh2nix/gb28181Simulator/internal/sched"
+	"github.com/lzh2nix/gb28181Simulator/internal/stats"
 	"github.com/lzh2nix/gb28181Simulator/internal/transport"
 	"github.com/lzh2nix/gb28181Simulator/internal/version"
 	"github.com/qiniu/x/xlog"
@@ -25,74 +26,183 @@ type Registar struct {
 	cfg *config.Config
 	// device registered or not, if not resend register in regretry
 	registed int32
+	// a REGISTER transaction is in flight, the transaction layer retransmits it
+	regPending int32
 	// reg sequence
 	regSeq int32
 	// last sent reginfo
 	regLeg *Leg
+	// the last REGISTER was an unregister, its challenge is answered in kind
+	unReg bool
+	// closed by the final response to the unregister sent by Unregister
+	unregDone chan struct{}
 
-	// send un-register  when close
-	CloseChan chan bool
+	// true registers now, false unregisters and stops registering until the
+	// next true
+	RegisterChan chan bool
+	paused       int32
 	// after 3 times timeout we need retry register
 	keepaliveTimeoutCount int32
 	keepaliveLegs         []Leg
 	keepaliveSeq          int32
+
+	// fires at the earliest of the deadlines below, which only the
+	// goroutine calling Tick touches
+	timer         *sched.Timer
+	nextReg       time.Time
+	nextRetry     time.Time
+	nextKeepalive time.Time
 }
 
 func NewRegistar(cfg *config.Config) (*Registar, error) {
 	reg := &Registar{
 		cfg:           cfg,
-		CloseChan:     make(chan bool),
+		RegisterChan:  make(chan bool),
 		keepaliveLegs: make([]Leg, cfg.MaxKeepaliveRetry),
 		regSeq:        0,
 		registed:      0,
 		keepaliveSeq:  0,
+		timer:         sched.Default.NewTimer(),
 	}
 	return reg, nil
 }
 
-func (r *Registar) Run(xlog *xlog.Logger, tr *transport.Transport) {
-	//	raddr := r.tr.Conn.RemoteAddr().(*net.UDPAddr)
-	regTimer := time.Tick(time.Duration(r.cfg.RegExpire) * time.Second)
-	regRetry := time.Tick(time.Second * 5)
-	keepaliveTimer := time.Tick(time.Duration(r.cfg.KeepaliveInterval) * time.Second)
+// how long to wait before registering again after a failed REGISTER
+const regRetryInterval = time.Second * 5
+
+// Start sends the first REGISTER and arms the registration and keepalive
+// timers on the shared scheduler. Call Tick whenever Timer fires, from the
+// goroutine handling the responses.
+func (r *Registar) Start(tr *transport.Transport) {
+	now := time.Now()
+	r.nextReg = now.Add(time.Duration(r.cfg.RegExpire) * time.Second)
+	r.nextRetry = now.Add(regRetryInterval)
+	r.nextKeepalive = now.Add(time.Duration(r.cfg.KeepaliveInterval) * time.Second)
+	r.resetTimer(now)
+	if atomic.LoadInt32(&r.paused) == 0 {
+		tr.Send <- r.newRegMsg(false, tr)
+	}
+}
 
-	// send first  register
-	laHost := tr.Conn.LocalAddr().(*net.UDPAddr).IP.String()
-	laPort := tr.Conn.LocalAddr().(*net.UDPAddr).Port
-	req := r.newRegMsg(false, laHost, laPort)
-	tr.Send <- req
+// Timer fires when Tick has something to send.
+func (r *Registar) Timer() <-chan time.Time {
+	return r.timer.C
+}
 
-	for {
-		select {
-		case <-regTimer:
-			req := r.newRegMsg(false, laHost, laPort)
+// Tick refreshes the registration, registers again after a failure or lost
+// keepalives and sends keepalives, whatever is due.
+func (r *Registar) Tick(tr *transport.Transport) {
+	now := time.Now()
+	if !now.Before(r.nextReg) {
+		r.nextReg = now.Add(time.Duration(r.cfg.RegExpire) * time.Second)
+		if atomic.LoadInt32(&r.paused) == 0 {
+			tr.Send <- r.newRegMsg(false, tr)
+		}
+	}
+	if !now.Before(r.nextRetry) {
+		r.nextRetry = now.Add(regRetryInterval)
+		if atomic.LoadInt32(&r.paused) == 0 && atomic.LoadInt32(&r.regPending) == 0 &&
+			(atomic.LoadInt32(&r.registed) == 0 || atomic.LoadInt32(&r.keepaliveTimeoutCount) >= 3) {
+			tr.Send <- r.newRegMsg(false, tr)
+		}
+	}
+	if !now.Before(r.nextKeepalive) {
+		r.nextKeepalive = now.Add(time.Duration(r.cfg.KeepaliveInterval) * time.Second)
+		if atomic.LoadInt32(&r.registed) == 1 {
+			atomic.AddInt32(&r.keepaliveTimeoutCount, 1)
+			req := r.newKeepaliveMsg(tr)
+			r.keepaliveLegs[int(r.keepaliveSeq)%r.cfg.MaxKeepaliveRetry] = Leg{req.CallID, req.From.Param.Get("tag").Value}
+			atomic.AddInt32(&r.keepaliveSeq, 1)
+			atomic.AddInt32(&r.keepaliveTimeoutCount, 1)
+			log.Println("send keepAlive")
 			tr.Send <- req
-		case <-regRetry:
-			if atomic.LoadInt32(&r.registed) == 0 || atomic.LoadInt32(&r.keepaliveTimeoutCount) >= 3 {
-				req := r.newRegMsg(false, laHost, laPort)
-				tr.Send <- req
-			}
-		case <-keepaliveTimer:
-			if atomic.LoadInt32(&r.registed) == 1 {
-				atomic.AddInt32(&r.keepaliveTimeoutCount, 1)
-				req := r.newKeepaliveMsg(laHost, laPort)
-				r.keepaliveLegs[int(r.keepaliveSeq)%r.cfg.MaxKeepaliveRetry] = Leg{req.CallID, req.From.Param.Get("tag").Value}
-				atomic.AddInt32(&r.keepaliveSeq, 1)
-				atomic.AddInt32(&r.keepaliveTimeoutCount, 1)
-				log.Println("send keepAlive")
-				tr.Send <- req
-			}
-		case <-r.CloseChan:
-			if atomic.CompareAndSwapInt32(&r.registed, 1, 0) {
-				req := r.newRegMsg(true, laHost, laPort)
-				tr.Send <- req
-			}
 		}
 	}
+	r.resetTimer(now)
+}
+
+func (r *Registar) resetTimer(now time.Time) {
+	next := r.nextReg
+	if r.nextRetry.Before(next) {
+		next = r.nextRetry
+	}
+	if r.nextKeepalive.Before(next) {
+		next = r.nextKeepalive
+	}
+	r.timer.Reset(next.Sub(now))
+}
+
+// Reconnected binds the registration to a reestablished connection right
+// away.
+func (r *Registar) Reconnected(tr *transport.Transport) {
+	if atomic.LoadInt32(&r.paused) == 0 {
+		log.Println("connection reestablished, register again")
+		tr.Send <- r.newRegMsg(false, tr)
+	}
+}
+
+// SetRegister handles a value received on RegisterChan.
+func (r *Registar) SetRegister(tr *transport.Transport, register bool) {
+	if register {
+		atomic.StoreInt32(&r.paused, 0)
+		tr.Send <- r.newRegMsg(false, tr)
+		return
+	}
+	atomic.StoreInt32(&r.paused, 1)
+	if r.setRegistered(0) {
+		tr.Send <- r.newRegMsg(true, tr)
+	}
+}
+
+// Stop disarms the timers.
+func (r *Registar) Stop() {
+	r.timer.Stop()
 }
 
-func (r *Registar) newRegMsg(unReg bool, localHost string, localPort int) *sip.Msg {
+// Unregister stops registering and, if the device is registered, sends an
+// unregister. It returns a channel closed by the final response, nil when
+// there is nothing to wait for. Call it after Stop, from the goroutine
+// handling the responses.
+func (r *Registar) Unregister(tr *transport.Transport) <-chan struct{} {
+	atomic.StoreInt32(&r.paused, 1)
+	if !r.setRegistered(0) {
+		return nil
+	}
+	r.unregDone = make(chan struct{})
+	tr.Send <- r.newRegMsg(true, tr)
+	return r.unregDone
+}
+
+// SetAutoRegister turns the initial and periodic REGISTER on or off, call it
+// before Start; RegisterChan still works either way.
+func (r *Registar) SetAutoRegister(on bool) {
+	if on {
+		atomic.StoreInt32(&r.paused, 0)
+	} else {
+		atomic.StoreInt32(&r.paused, 1)
+	}
+}
+
+// Registered reports whether the last REGISTER succeeded.
+func (r *Registar) Registered() bool {
+	return atomic.LoadInt32(&r.registed) == 1
+}
+
+// setRegistered updates the registration state and reports whether it
+// changed.
+func (r *Registar) setRegistered(v int32) bool {
+	old := atomic.SwapInt32(&r.registed, v)
+	if old == v {
+		return false
+	}
+	stats.AddGauge(stats.RegisteredDevices, int64(v-old))
+	return true
+}
+
+func (r *Registar) newRegMsg(unReg bool, tr *transport.Transport) *sip.Msg {
+	localHost, localPort := tr.ContactAddr()
 	atomic.AddInt32(&r.regSeq, 1)
+	atomic.StoreInt32(&r.regPending, 1)
 	expire := r.cfg.RegExpire
 	if unReg {
 		expire = 0
@@ -109,11 +219,12 @@ func (r *Registar) newRegMsg(unReg bool, localHost string, localPort int) *sip.M
 			Host:   r.cfg.Realm,
 		},
 		Via: &sip.Via{
-			Version:  "2.0",
-			Protocol: "SIP",
-			Host:     localHost,
-			Port:     uint16(localPort),
-			Param:    &sip.Param{Name: "branch", Value: util.GenerateBranch()},
+			Version:   "2.0",
+			Protocol:  "SIP",
+			Transport: tr.Proto(),
+			Host:      transport.ViaHost(localHost),
+			Port:      uint16(localPort),
+			Param:     &sip.Param{Name: "branch", Value: util.GenerateBranch(), Next: &sip.Param{Name: "rport"}},
 		},
 		Contact: &sip.Addr{
 			Uri: &sip.URI{
@@ -142,6 +253,7 @@ func (r *Registar) newRegMsg(unReg bool, localHost string, localPort int) *sip.M
 		req.From.Param = &sip.Param{Name: "tag", Value: r.regLeg.fromTag, Next: nil}
 	}
 	r.regLeg = &Leg{req.CallID, req.From.Param.Get("tag").Value}
+	r.unReg = unReg
 	return req
 }
 func (r *Registar) HandleResponse(xl *xlog.Logger, tr *transport.Transport, resp *sip.Msg) bool {
@@ -151,6 +263,10 @@ func (r *Registar) HandleResponse(xl *xlog.Logger, tr *transport.Transport, resp
 		return true
 	}
 	if resp.CSeqMethod == sip.MethodMessage && r.keepAliveLeg(resp) {
+		if resp.Status == 408 {
+			xl.Error("keepAlive timeout, callId:", resp.CallID)
+			return true
+		}
 		log.Println("got keepAlive response")
 		atomic.StoreInt32(&r.keepaliveTimeoutCount, 0)
 		return true
@@ -170,6 +286,19 @@ func (r *Registar) keepAliveLeg(resp *sip.Msg) bool {
 func (r *Registar) handleRegResp(xl *xlog.Logger, tr *transport.Transport, resp *sip.Msg) {
 	if r.regLeg.callID == resp.CallID &&
 		strings.EqualFold(r.regLeg.fromTag, resp.From.Param.Get("tag").Value) {
+		if resp.Status >= 200 {
+			atomic.StoreInt32(&r.regPending, 0)
+		}
+		if r.unReg && r.unregDone != nil && resp.Status >= 200 && resp.Status != 401 {
+			close(r.unregDone)
+			r.unregDone = nil
+		}
+		natChanged := tr.LearnPublicAddr(resp.Via)
+		if resp.Status == 408 {
+			xl.Error("register timeout, callId:", resp.CallID)
+			r.setRegistered(0)
+			return
+		}
 		if resp.Status == 401 {
 			ch, err := parseChallenge(resp.WWWAuthenticate)
 			if err != nil {
@@ -186,9 +315,7 @@ func (r *Registar) handleRegResp(xl *xlog.Logger, tr *transport.Transport, resp
 				Algorithm:  ch.Algorithm,
 				MessageQop: ch.Qop,
 			}
-			laHost := tr.Conn.LocalAddr().(*net.UDPAddr).IP.String()
-			laPort := tr.Conn.LocalAddr().(*net.UDPAddr).Port
-			req := r.newRegMsg(false, laHost, laPort)
+			req := r.newRegMsg(r.unReg, tr)
 			authHeader, err := cred.authorize()
 			if err != nil {
 				xl.Error("generate www Auth Header failed ,err = ", err)
@@ -198,7 +325,13 @@ func (r *Registar) handleRegResp(xl *xlog.Logger, tr *transport.Transport, resp
 			tr.Send <- req
 		}
 		if resp.Status == 200 && resp.Expires != 0 {
-			atomic.StoreInt32(&r.registed, 1)
+			r.setRegistered(1)
+			if natChanged {
+				// the platform saw us from another address than the Contact we sent
+				host, port := tr.ContactAddr()
+				xl.Infof("public address is %s:%d, register again", host, port)
+				tr.Send <- r.newRegMsg(false, tr)
+			}
 		}
 	}
 }
@@ -220,7 +353,8 @@ func (ke *keepalive) Data() []byte {
 	data, _ := xml.MarshalIndent(ke, "  ", "    ")
 	return []byte(xml.Header + string(data))
 }
-func (r *Registar) newKeepaliveMsg(localHost string, localPort int) *sip.Msg {
+func (r *Registar) newKeepaliveMsg(tr *transport.Transport) *sip.Msg {
+	localHost, localPort := tr.ContactAddr()
 	req := &sip.Msg{
 		CSeq:       int(r.regSeq),
 		CallID:     util.GenerateCallID(),
@@ -233,12 +367,13 @@ func (r *Registar) newKeepaliveMsg(localHost string, localPort int) *sip.Msg {
 			Host:   r.cfg.Realm,
 		},
 		Via: &sip.Via{
-			Version:  "2.0",
-			Protocol: "SIP",
-			Host:     localHost,
-			Port:     uint16(localPort),
+			Version:   "2.0",
+			Protocol:  "SIP",
+			Transport: tr.Proto(),
+			Host:      transport.ViaHost(localHost),
+			Port:      uint16(localPort),
 
-			Param: &sip.Param{Name: "branch", Value: util.GenerateBranch()},
+			Param: &sip.Param{Name: "branch", Value: util.GenerateBranch(), Next: &sip.Param{Name: "rport"}},
 		},
 		Contact: &sip.Addr{
 			Uri: &sip.URI{
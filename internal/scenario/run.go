@@ -0,0 +1,153 @@
+package scenario
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lzh2nix/gb28181Simulator/internal/alarm"
+	"github.com/lzh2nix/gb28181Simulator/internal/config"
+	"github.com/lzh2nix/gb28181Simulator/internal/useragent"
+	"github.com/qiniu/x/xlog"
+)
+
+// events buffered between the device and the running step
+const eventQueueSize = 1024
+
+var (
+	ErrTimeout   = errors.New("timeout")
+	ErrNoSession = errors.New("no active session")
+)
+
+// Result is the outcome of one step.
+type Result struct {
+	Step    int
+	Name    string
+	Elapsed time.Duration
+	Err     error
+}
+
+// Run starts a device with automatic registration turned off, runs the steps
+// in order and stops at the first failure. The device has stopped when Run
+// returns.
+func Run(xlog *xlog.Logger, cfg *config.Config, sc *Scenario) ([]Result, error) {
+	srv, err := useragent.NewService(xlog, cfg)
+	if err != nil {
+		return nil, err
+	}
+	events := make(chan useragent.Event, eventQueueSize)
+	srv.OnEvent(func(e useragent.Event) {
+		select {
+		case events <- e:
+		default:
+			xlog.Errorf("scenario event queue full, drop %s %d", e.Method, e.Status)
+		}
+	})
+	srv.SetAutoRegister(false)
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		srv.Serve(ctx)
+		close(stopped)
+	}()
+	defer func() {
+		cancel()
+		<-stopped
+	}()
+
+	r := &runner{xlog: xlog, cfg: cfg, srv: srv, events: events}
+	var results []Result
+	for i := range sc.Steps {
+		st := &sc.Steps[i]
+		start := time.Now()
+		err := r.step(st)
+		results = append(results, Result{Step: i + 1, Name: st.Name, Elapsed: time.Since(start), Err: err})
+		if err != nil {
+			return results, fmt.Errorf("step %d %q: %w", i+1, st.Name, err)
+		}
+	}
+	return results, nil
+}
+
+type runner struct {
+	xlog   *xlog.Logger
+	cfg    *config.Config
+	srv    *useragent.Service
+	events chan useragent.Event
+}
+
+func (r *runner) step(st *Step) error {
+	switch st.Do {
+	case "":
+		return r.expect(st)
+	case "register":
+		r.srv.Register()
+	case "unregister":
+		r.srv.Unregister()
+	case "wait":
+		time.Sleep(time.Duration(st.Duration))
+	case "stream":
+		return r.stream(st)
+	case "hangup":
+		sessions := r.srv.Status().Sessions
+		if len(sessions) == 0 {
+			return ErrNoSession
+		}
+		return r.srv.Hangup(sessions[0].CallID)
+	case "online", "offline":
+		return r.srv.SetChannelStatus(st.Channel, st.Do == "online")
+	case "alarm":
+		r.srv.Alarm(alarm.Alarm{DeviceID: st.Channel, Description: st.Description})
+	}
+	return nil
+}
+
+func (r *runner) expect(st *Step) error {
+	timeout := time.NewTimer(time.Duration(st.Timeout))
+	defer timeout.Stop()
+	for {
+		select {
+		case e := <-r.events:
+			if st.match(e) {
+				return nil
+			}
+			r.xlog.Debugf("scenario skip %s %d", e.Method, e.Status)
+		case <-timeout.C:
+			return ErrTimeout
+		}
+	}
+}
+
+func (st *Step) match(e useragent.Event) bool {
+	if (st.Expect == "request") != (e.Status == 0) {
+		return false
+	}
+	if !strings.EqualFold(st.Method, e.Method) {
+		return false
+	}
+	if st.Status != 0 && st.Status != e.Status {
+		return false
+	}
+	if st.CmdType != "" && !strings.EqualFold(st.CmdType, e.CmdType) {
+		return false
+	}
+	return st.Target == "" || st.Target == e.Target
+}
+
+// stream checks that a session is up now and still up after the duration.
+func (r *runner) stream(st *Step) error {
+	sessions := r.srv.Status().Sessions
+	if len(sessions) == 0 {
+		return ErrNoSession
+	}
+	callID := sessions[0].CallID
+	time.Sleep(time.Duration(st.Duration))
+	for _, s := range r.srv.Status().Sessions {
+		if s.CallID == callID {
+			return nil
+		}
+	}
+	return fmt.Errorf("session %s ended early", callID)
+}
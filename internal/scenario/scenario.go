@@ -0,0 +1,169 @@
+package scenario
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+const defaultTimeout = time.Second * 10
+
+var ErrNoSteps = errors.New("scenario has no steps")
+
+// Duration reads "1.5s", "200ms" or a number of seconds.
+type Duration time.Duration
+
+func (d *Duration) set(v interface{}) error {
+	switch v := v.(type) {
+	case string:
+		t, err := time.ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		*d = Duration(t)
+	case float64:
+		*d = Duration(v * float64(time.Second))
+	case int:
+		*d = Duration(time.Duration(v) * time.Second)
+	default:
+		return fmt.Errorf("bad duration %v", v)
+	}
+	return nil
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	return d.set(v)
+}
+
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var v interface{}
+	if err := unmarshal(&v); err != nil {
+		return err
+	}
+	return d.set(v)
+}
+
+// Scenario is a script of steps run against the platform by one device. A
+// step either does something (Do) or waits for a message (Expect).
+type Scenario struct {
+	Name string `json:"name" yaml:"name"`
+	// default step timeout, 10s when unset
+	Timeout Duration `json:"timeout" yaml:"timeout"`
+	Steps   []Step   `json:"steps" yaml:"steps"`
+}
+
+// Step actions:
+//
+//	register, unregister         send REGISTER, the 401 is answered for us
+//	wait                         sleep Duration
+//	stream                       a session must stay up for Duration
+//	hangup                       BYE the current session
+//	online, offline              catalog ON/OFF notify for Channel
+//	alarm                        alarm for Channel (the device if empty)
+//
+// Expect is "request" or "response", matched on Method and, when set, Status,
+// CmdType and Target (the Request-URI user). Messages that don't match are
+// skipped until Timeout.
+type Step struct {
+	Name        string   `json:"name" yaml:"name"`
+	Do          string   `json:"do" yaml:"do"`
+	Expect      string   `json:"expect" yaml:"expect"`
+	Method      string   `json:"method" yaml:"method"`
+	Status      int      `json:"status" yaml:"status"`
+	CmdType     string   `json:"cmdType" yaml:"cmdType"`
+	Target      string   `json:"target" yaml:"target"`
+	Channel     string   `json:"channel" yaml:"channel"`
+	Description string   `json:"description" yaml:"description"`
+	Timeout     Duration `json:"timeout" yaml:"timeout"`
+	Duration    Duration `json:"duration" yaml:"duration"`
+}
+
+var actions = map[string]bool{
+	"register": true, "unregister": true, "wait": true, "stream": true,
+	"hangup": true, "online": true, "offline": true, "alarm": true,
+}
+
+// Load reads a scenario, as yaml when the file ends in .yaml or .yml and as
+// json otherwise.
+func Load(path string) (*Scenario, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var sc Scenario
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.UnmarshalStrict(b, &sc)
+	default:
+		err = json.Unmarshal(b, &sc)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if sc.Name == "" {
+		sc.Name = filepath.Base(path)
+	}
+	return &sc, sc.validate()
+}
+
+func (sc *Scenario) validate() error {
+	if len(sc.Steps) == 0 {
+		return ErrNoSteps
+	}
+	for i := range sc.Steps {
+		st := &sc.Steps[i]
+		switch {
+		case st.Do != "" && st.Expect != "":
+			return fmt.Errorf("step %d: both do and expect", i+1)
+		case st.Do != "" && !actions[st.Do]:
+			return fmt.Errorf("step %d: unknown action %q", i+1, st.Do)
+		case st.Expect != "" && st.Expect != "request" && st.Expect != "response":
+			return fmt.Errorf("step %d: expect must be request or response", i+1)
+		case st.Expect != "" && st.Method == "":
+			return fmt.Errorf("step %d: expect needs a method", i+1)
+		case st.Do == "" && st.Expect == "":
+			return fmt.Errorf("step %d: needs do or expect", i+1)
+		case (st.Do == "wait" || st.Do == "stream") && st.Duration <= 0:
+			return fmt.Errorf("step %d: %s needs a duration", i+1, st.Do)
+		case (st.Do == "online" || st.Do == "offline") && st.Channel == "":
+			return fmt.Errorf("step %d: %s needs a channel", i+1, st.Do)
+		}
+		if st.Timeout == 0 {
+			st.Timeout = sc.Timeout
+		}
+		if st.Timeout == 0 {
+			st.Timeout = Duration(defaultTimeout)
+		}
+		if st.Name == "" {
+			st.Name = st.describe()
+		}
+	}
+	return nil
+}
+
+func (st *Step) describe() string {
+	if st.Do != "" {
+		if st.Duration > 0 {
+			return fmt.Sprintf("%s %s", st.Do, time.Duration(st.Duration))
+		}
+		return strings.TrimSpace(st.Do + " " + st.Channel)
+	}
+	s := "expect " + st.Expect + " " + st.Method
+	if st.Status != 0 {
+		s += fmt.Sprintf(" %d", st.Status)
+	}
+	if st.CmdType != "" {
+		s += " " + st.CmdType
+	}
+	return s
+}
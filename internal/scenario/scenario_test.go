@@ -0,0 +1,142 @@
+package scenario
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lzh2nix/gb28181Simulator/internal/useragent"
+)
+
+func TestLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sim-scenario")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		file string
+		text string
+		// error substring, empty when the file is valid
+		err   string
+		name  string
+		steps []Step
+	}{
+		{"register.yaml", `
+name: register
+timeout: 2s
+steps:
+  - do: register
+  - expect: response
+    method: REGISTER
+    status: 401
+  - expect: response
+    method: REGISTER
+    status: 200
+    timeout: 500ms
+  - do: wait
+    duration: 1.5
+  - do: online
+    channel: "34020000001320000001"
+`, "", "register", []Step{
+			{Name: "register", Do: "register", Timeout: Duration(time.Second * 2)},
+			{Name: "expect response REGISTER 401", Expect: "response", Method: "REGISTER", Status: 401, Timeout: Duration(time.Second * 2)},
+			{Name: "expect response REGISTER 200", Expect: "response", Method: "REGISTER", Status: 200, Timeout: Duration(time.Millisecond * 500)},
+			{Name: "wait 1.5s", Do: "wait", Duration: Duration(time.Millisecond * 1500), Timeout: Duration(time.Second * 2)},
+			{Name: "online 34020000001320000001", Do: "online", Channel: "34020000001320000001", Timeout: Duration(time.Second * 2)},
+		}},
+		{"catalog.json", `{"steps": [
+			{"name": "catalog query", "expect": "request", "method": "MESSAGE", "cmdType": "Catalog"},
+			{"do": "stream", "duration": "200ms", "timeout": 3}
+		]}`, "", "catalog.json", []Step{
+			{Name: "catalog query", Expect: "request", Method: "MESSAGE", CmdType: "Catalog", Timeout: Duration(defaultTimeout)},
+			{Name: "stream 200ms", Do: "stream", Duration: Duration(time.Millisecond * 200), Timeout: Duration(time.Second * 3)},
+		}},
+		{"scenario.yml", "steps:\n  - do: hangup\n", "", "scenario.yml", []Step{
+			{Name: "hangup", Do: "hangup", Timeout: Duration(defaultTimeout)},
+		}},
+		{"empty.yaml", "name: empty\n", ErrNoSteps.Error(), "", nil},
+		{"unknown-field.yaml", "steps:\n  - do: register\n    color: red\n", "color", "", nil},
+		{"bad.json", `{"steps": [`, "unexpected end", "", nil},
+		{"bad-duration.yaml", "steps:\n  - do: wait\n    duration: soon\n", "soon", "", nil},
+		{"both.yaml", "steps:\n  - do: register\n    expect: response\n", "step 1: both do and expect", "", nil},
+		{"action.yaml", "steps:\n  - do: register\n  - do: reboot\n", `step 2: unknown action "reboot"`, "", nil},
+		{"expect.yaml", "steps:\n  - expect: message\n    method: MESSAGE\n", "step 1: expect must be request or response", "", nil},
+		{"method.yaml", "steps:\n  - expect: request\n", "step 1: expect needs a method", "", nil},
+		{"nothing.yaml", "steps:\n  - name: idle\n", "step 1: needs do or expect", "", nil},
+		{"wait.yaml", "steps:\n  - do: wait\n", "step 1: wait needs a duration", "", nil},
+		{"stream.yaml", "steps:\n  - do: stream\n    duration: -1s\n", "step 1: stream needs a duration", "", nil},
+		{"offline.yaml", "steps:\n  - do: offline\n", "step 1: offline needs a channel", "", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			path := filepath.Join(dir, tt.file)
+			if err := ioutil.WriteFile(path, []byte(tt.text), 0600); err != nil {
+				t.Fatal(err)
+			}
+			sc, err := Load(path)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("err = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sc.Name != tt.name {
+				t.Errorf("name = %q, want %q", sc.Name, tt.name)
+			}
+			if len(sc.Steps) != len(tt.steps) {
+				t.Fatalf("%d steps, want %d", len(sc.Steps), len(tt.steps))
+			}
+			for i, st := range sc.Steps {
+				if st != tt.steps[i] {
+					t.Errorf("step %d = %+v, want %+v", i+1, st, tt.steps[i])
+				}
+			}
+		})
+	}
+}
+
+func TestLoadMissingFile(t *testing.T) {
+	if _, err := Load(filepath.Join(os.TempDir(), "no-such-scenario.yaml")); !os.IsNotExist(err) {
+		t.Errorf("err = %v, want not exist", err)
+	}
+}
+
+func TestMatch(t *testing.T) {
+	catalogQuery := useragent.Event{Method: "MESSAGE", CmdType: "Catalog", Target: "34020000001110000001"}
+	regOK := useragent.Event{Method: "REGISTER", Status: 200}
+	tests := []struct {
+		name  string
+		step  Step
+		event useragent.Event
+		want  bool
+	}{
+		{"request", Step{Expect: "request", Method: "MESSAGE"}, catalogQuery, true},
+		{"method case", Step{Expect: "request", Method: "message"}, catalogQuery, true},
+		{"other method", Step{Expect: "request", Method: "INVITE"}, catalogQuery, false},
+		{"request is no response", Step{Expect: "response", Method: "MESSAGE"}, catalogQuery, false},
+		{"cmd type", Step{Expect: "request", Method: "MESSAGE", CmdType: "catalog"}, catalogQuery, true},
+		{"other cmd type", Step{Expect: "request", Method: "MESSAGE", CmdType: "DeviceInfo"}, catalogQuery, false},
+		{"target", Step{Expect: "request", Method: "MESSAGE", Target: "34020000001110000001"}, catalogQuery, true},
+		{"other target", Step{Expect: "request", Method: "MESSAGE", Target: "34020000001320000001"}, catalogQuery, false},
+		{"response", Step{Expect: "response", Method: "REGISTER"}, regOK, true},
+		{"status", Step{Expect: "response", Method: "REGISTER", Status: 200}, regOK, true},
+		{"other status", Step{Expect: "response", Method: "REGISTER", Status: 401}, regOK, false},
+		{"response is no request", Step{Expect: "request", Method: "REGISTER"}, regOK, false},
+		{"timeout response", Step{Expect: "response", Method: "INVITE", Status: 408}, useragent.Event{Method: "INVITE", Status: 408}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.step.match(tt.event); got != tt.want {
+				t.Errorf("match = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
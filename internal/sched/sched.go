@@ -0,0 +1,137 @@
+// Package sched runs the timers of many devices from one goroutine, so that
+// a bench with thousands of devices doesn't keep a timer goroutine for each.
+package sched
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// Scheduler fires Timers from a single goroutine, started with the first
+// Reset.
+type Scheduler struct {
+	once sync.Once
+	mu   sync.Mutex
+	h    timerHeap
+	// woken when the earliest deadline moved
+	wake chan struct{}
+}
+
+// Default is the scheduler shared by every device of the process.
+var Default = New()
+
+func New() *Scheduler {
+	return &Scheduler{wake: make(chan struct{}, 1)}
+}
+
+// Timer delivers the time on C once its deadline has passed. Like a
+// time.Timer it fires once per Reset, a fire that isn't received before the
+// next one is dropped.
+type Timer struct {
+	C <-chan time.Time
+
+	s    *Scheduler
+	c    chan time.Time
+	when time.Time
+	// position in the heap, -1 when not scheduled
+	index int
+}
+
+func (s *Scheduler) NewTimer() *Timer {
+	c := make(chan time.Time, 1)
+	return &Timer{C: c, s: s, c: c, index: -1}
+}
+
+// Reset makes t fire after d, replacing the previous deadline.
+func (t *Timer) Reset(d time.Duration) {
+	s := t.s
+	s.once.Do(func() { go s.run() })
+	s.mu.Lock()
+	t.when = time.Now().Add(d)
+	if t.index < 0 {
+		heap.Push(&s.h, t)
+	} else {
+		heap.Fix(&s.h, t.index)
+	}
+	first := s.h[0] == t
+	s.mu.Unlock()
+	if first {
+		s.notify()
+	}
+}
+
+// Stop cancels the pending fire, one already delivered stays on C.
+func (t *Timer) Stop() {
+	s := t.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t.index >= 0 {
+		heap.Remove(&s.h, t.index)
+	}
+}
+
+func (s *Scheduler) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Scheduler) run() {
+	wait := time.NewTimer(time.Hour)
+	for {
+		s.mu.Lock()
+		now := time.Now()
+		for len(s.h) > 0 && !s.h[0].when.After(now) {
+			t := heap.Pop(&s.h).(*Timer)
+			select {
+			case t.c <- now:
+			default:
+			}
+		}
+		d := time.Hour
+		if len(s.h) > 0 {
+			d = s.h[0].when.Sub(now)
+		}
+		s.mu.Unlock()
+
+		if !wait.Stop() {
+			select {
+			case <-wait.C:
+			default:
+			}
+		}
+		wait.Reset(d)
+		select {
+		case <-wait.C:
+		case <-s.wake:
+		}
+	}
+}
+
+// timerHeap orders timers by deadline, for container/heap.
+type timerHeap []*Timer
+
+func (h timerHeap) Len() int           { return len(h) }
+func (h timerHeap) Less(i, j int) bool { return h[i].when.Before(h[j].when) }
+func (h timerHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *timerHeap) Push(x interface{}) {
+	t := x.(*Timer)
+	t.index = len(*h)
+	*h = append(*h, t)
+}
+
+func (h *timerHeap) Pop() interface{} {
+	old := *h
+	t := old[len(old)-1]
+	old[len(old)-1] = nil
+	t.index = -1
+	*h = old[:len(old)-1]
+	return t
+}
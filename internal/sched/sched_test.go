@@ -0,0 +1,55 @@
+package sched
+
+import (
+	"testing"
+	"time"
+)
+
+// Timers fire in deadline order, a Reset moves the deadline and a stopped
+// timer doesn't fire.
+func TestTimers(t *testing.T) {
+	s := New()
+	late, early, moved, stopped := s.NewTimer(), s.NewTimer(), s.NewTimer(), s.NewTimer()
+	late.Reset(time.Millisecond * 60)
+	early.Reset(time.Millisecond * 20)
+	moved.Reset(time.Hour)
+	moved.Reset(time.Millisecond * 40)
+	stopped.Reset(time.Millisecond * 30)
+	stopped.Stop()
+
+	start := time.Now()
+	for i, tm := range []*Timer{early, moved, late} {
+		select {
+		case <-tm.C:
+		case <-time.After(time.Second):
+			t.Fatalf("timer %d didn't fire", i)
+		}
+		if d, min := time.Since(start), time.Duration(i+1)*time.Millisecond*20; d < min-time.Millisecond*5 {
+			t.Errorf("timer %d fired after %v, want %v", i, d, min)
+		}
+	}
+	select {
+	case <-stopped.C:
+		t.Error("stopped timer fired")
+	case <-time.After(time.Millisecond * 50):
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.h) != 0 {
+		t.Errorf("%d timers left scheduled", len(s.h))
+	}
+}
+
+// A timer fires again once Reset after firing.
+func TestTimerReset(t *testing.T) {
+	s := New()
+	tm := s.NewTimer()
+	for i := 0; i < 3; i++ {
+		tm.Reset(time.Millisecond * 10)
+		select {
+		case <-tm.C:
+		case <-time.After(time.Second):
+			t.Fatalf("fire %d missing", i)
+		}
+	}
+}
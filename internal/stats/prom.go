@@ -0,0 +1,90 @@
+package stats
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// series renders a sample name in the prometheus text format.
+func series(name, labels string) string {
+	if labels == "" {
+		return name
+	}
+	return name + "{" + labels + "}"
+}
+
+// Handler serves every metric in the prometheus text exposition format
+// (version 0.0.4), so that the simulator can be scraped without pulling in
+// the client library.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetrics(w)
+	})
+}
+
+func writeMetrics(w io.Writer) {
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	names := make([]string, 0, len(std.hists))
+	for name := range std.hists {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintln(w, "# HELP gbsim_latency_seconds Request round-trip and invite to first rtp latency.")
+	fmt.Fprintln(w, "# TYPE gbsim_latency_seconds histogram")
+	for _, name := range names {
+		h := std.hists[name]
+		kind := "kind=" + strconv.Quote(name)
+		var cum int64
+		for i, b := range bounds {
+			cum += h.counts[i]
+			fmt.Fprintf(w, "gbsim_latency_seconds_bucket{%s,le=\"%g\"} %d\n", kind, b.Seconds(), cum)
+		}
+		fmt.Fprintf(w, "gbsim_latency_seconds_bucket{%s,le=\"+Inf\"} %d\n", kind, h.n)
+		fmt.Fprintf(w, "gbsim_latency_seconds_sum{%s} %g\n", kind, h.sum.Seconds())
+		fmt.Fprintf(w, "gbsim_latency_seconds_count{%s} %d\n", kind, h.n)
+	}
+
+	kinds := make([]string, 0, len(std.codes))
+	for kind := range std.codes {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	fmt.Fprintln(w, "# HELP gbsim_responses_total Final responses to our requests, timeouts count as 408.")
+	fmt.Fprintln(w, "# TYPE gbsim_responses_total counter")
+	for _, kind := range kinds {
+		for _, code := range sortedCodes(std.codes[kind]) {
+			fmt.Fprintf(w, "gbsim_responses_total{kind=%q,code=\"%d\"} %d\n", kind, code, std.codes[kind][code])
+		}
+	}
+	fmt.Fprintln(w, "# HELP gbsim_keepalive_timeouts_total Keepalives that got no response.")
+	fmt.Fprintln(w, "# TYPE gbsim_keepalive_timeouts_total counter")
+	fmt.Fprintf(w, "gbsim_keepalive_timeouts_total %d\n", std.codes[Keepalive][408])
+
+	names = names[:0]
+	for name := range std.metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		m := std.metrics[name]
+		typ := "counter"
+		if m.gauge {
+			typ = "gauge"
+		}
+		fmt.Fprintf(w, "# TYPE %s %s\n", name, typ)
+		labels := make([]string, 0, len(m.values))
+		for l := range m.values {
+			labels = append(labels, l)
+		}
+		sort.Strings(labels)
+		for _, l := range labels {
+			fmt.Fprintf(w, "%s %d\n", series(name, l), m.values[l])
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package stats
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandler(t *testing.T) {
+	defer useRegistry()()
+	Response(Register, 200, time.Millisecond)
+	Timeout(Keepalive)
+	AddGauge(RegisteredDevices, 1)
+	RTPSent("tcp", 1400)
+
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := w.Header().Get("Content-Type"); ct != "text/plain; version=0.0.4" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	lines := make(map[string]bool)
+	for _, l := range strings.Split(w.Body.String(), "\n") {
+		lines[l] = true
+	}
+	for _, want := range []string{
+		"# TYPE gbsim_latency_seconds histogram",
+		`gbsim_latency_seconds_bucket{kind="register",le="0.001"} 1`,
+		`gbsim_latency_seconds_bucket{kind="register",le="60"} 1`,
+		`gbsim_latency_seconds_bucket{kind="register",le="+Inf"} 1`,
+		`gbsim_latency_seconds_sum{kind="register"} 0.001`,
+		`gbsim_latency_seconds_count{kind="register"} 1`,
+		"# TYPE gbsim_responses_total counter",
+		`gbsim_responses_total{kind="keepalive",code="408"} 1`,
+		`gbsim_responses_total{kind="register",code="200"} 1`,
+		"gbsim_keepalive_timeouts_total 1",
+		"# TYPE gbsim_registered_devices gauge",
+		"gbsim_registered_devices 1",
+		"# TYPE gbsim_rtp_packets_sent_total counter",
+		`gbsim_rtp_packets_sent_total{mode="tcp"} 1`,
+		`gbsim_rtp_bytes_sent_total{mode="tcp"} 1400`,
+	} {
+		if !lines[want] {
+			t.Errorf("missing line %s", want)
+		}
+	}
+	if t.Failed() {
+		t.Log(w.Body.String())
+	}
+}
+
+func TestSeries(t *testing.T) {
+	if s := series("a", ""); s != "a" {
+		t.Errorf("series without labels = %s", s)
+	}
+	if s := series("a", `mode="udp"`); s != `a{mode="udp"}` {
+		t.Errorf("series with labels = %s", s)
+	}
+}
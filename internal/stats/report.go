@@ -0,0 +1,186 @@
+package stats
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Summary describes one histogram, durations are in milliseconds so that the
+// json and csv output can be compared across runs without unit parsing.
+type Summary struct {
+	Count int64   `json:"count"`
+	Min   float64 `json:"minMs"`
+	Mean  float64 `json:"meanMs"`
+	P50   float64 `json:"p50Ms"`
+	P90   float64 `json:"p90Ms"`
+	P99   float64 `json:"p99Ms"`
+	Max   float64 `json:"maxMs"`
+}
+
+type Report struct {
+	Start    time.Time          `json:"start"`
+	Duration float64            `json:"durationSec"`
+	Latency  map[string]Summary `json:"latency"`
+	// final response status counts by request kind
+	Responses map[string]map[int]int64 `json:"responses"`
+	// counters and gauges by name{labels}
+	Counters map[string]int64 `json:"counters"`
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// Snapshot returns the numbers collected since the process started.
+func Snapshot() *Report {
+	std.mu.Lock()
+	defer std.mu.Unlock()
+	r := &Report{
+		Start:     std.start,
+		Duration:  time.Since(std.start).Seconds(),
+		Latency:   make(map[string]Summary),
+		Responses: make(map[string]map[int]int64),
+		Counters:  make(map[string]int64),
+	}
+	for name, h := range std.hists {
+		if h.n == 0 {
+			continue
+		}
+		r.Latency[name] = Summary{
+			Count: h.n,
+			Min:   ms(h.min),
+			Mean:  ms(h.sum / time.Duration(h.n)),
+			P50:   ms(h.quantile(0.5)),
+			P90:   ms(h.quantile(0.9)),
+			P99:   ms(h.quantile(0.99)),
+			Max:   ms(h.max),
+		}
+	}
+	for kind, c := range std.codes {
+		m := make(map[int]int64, len(c))
+		for status, n := range c {
+			m[status] = n
+		}
+		r.Responses[kind] = m
+	}
+	for name, m := range std.metrics {
+		for labels, v := range m.values {
+			r.Counters[series(name, labels)] = v
+		}
+	}
+	return r
+}
+
+func sortedKeys(m map[string]Summary) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedCodes(m map[int]int64) []int {
+	codes := make([]int, 0, len(m))
+	for c := range m {
+		codes = append(codes, c)
+	}
+	sort.Ints(codes)
+	return codes
+}
+
+func (r *Report) kinds() []string {
+	kinds := make([]string, 0, len(r.Responses))
+	for k := range r.Responses {
+		kinds = append(kinds, k)
+	}
+	sort.Strings(kinds)
+	return kinds
+}
+
+// Print writes a human readable report.
+func (r *Report) Print(w io.Writer) {
+	fmt.Fprintf(w, "=== report, %.1fs since %s ===\n", r.Duration, r.Start.Format(time.RFC3339))
+	fmt.Fprintf(w, "%-14s %8s %9s %9s %9s %9s %9s %9s\n", "latency(ms)", "count", "min", "mean", "p50", "p90", "p99", "max")
+	for _, name := range sortedKeys(r.Latency) {
+		s := r.Latency[name]
+		fmt.Fprintf(w, "%-14s %8d %9.1f %9.1f %9.1f %9.1f %9.1f %9.1f\n", name, s.Count, s.Min, s.Mean, s.P50, s.P90, s.P99, s.Max)
+	}
+	for _, kind := range r.kinds() {
+		var parts []string
+		for _, code := range sortedCodes(r.Responses[kind]) {
+			parts = append(parts, fmt.Sprintf("%d:%d", code, r.Responses[kind][code]))
+		}
+		fmt.Fprintf(w, "%-14s %s\n", kind, strings.Join(parts, " "))
+	}
+	names := make([]string, 0, len(r.Counters))
+	for name := range r.Counters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "%s %d\n", name, r.Counters[name])
+	}
+}
+
+func (r *Report) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+// WriteCSV writes one row per histogram and per response code.
+func (r *Report) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"metric", "name", "count", "min_ms", "mean_ms", "p50_ms", "p90_ms", "p99_ms", "max_ms"})
+	f := func(v float64) string { return strconv.FormatFloat(v, 'f', 3, 64) }
+	for _, name := range sortedKeys(r.Latency) {
+		s := r.Latency[name]
+		cw.Write([]string{"latency", name, strconv.FormatInt(s.Count, 10), f(s.Min), f(s.Mean), f(s.P50), f(s.P90), f(s.P99), f(s.Max)})
+	}
+	for _, kind := range r.kinds() {
+		c := r.Responses[kind]
+		for _, code := range sortedCodes(c) {
+			cw.Write([]string{"response", kind + " " + strconv.Itoa(code), strconv.FormatInt(c[code], 10)})
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// WriteFile writes the report as csv when path ends in .csv and as json
+// otherwise.
+func (r *Report) WriteFile(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		err = r.WriteCSV(f)
+	} else {
+		err = r.WriteJSON(f)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Dump prints the current report to w and, unless path is empty, writes it
+// to path too.
+func Dump(w io.Writer, path string) error {
+	r := Snapshot()
+	r.Print(w)
+	if path == "" {
+		return nil
+	}
+	return r.WriteFile(path)
+}
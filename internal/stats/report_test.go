@@ -0,0 +1,116 @@
+package stats
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testReport() *Report {
+	return &Report{
+		Start:    time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+		Duration: 10,
+		Latency: map[string]Summary{
+			Register: {Count: 2, Min: 1, Mean: 1.5, P50: 1, P90: 2, P99: 2, Max: 2},
+			Catalog:  {Count: 1, Min: 0.25, Mean: 0.25, P50: 0.25, P90: 0.25, P99: 0.25, Max: 0.25},
+		},
+		Responses: map[string]map[int]int64{
+			Register:  {401: 2, 200: 2},
+			Keepalive: {408: 1},
+		},
+		Counters: map[string]int64{RegisteredDevices: 1},
+	}
+}
+
+func TestWriteCSV(t *testing.T) {
+	var b bytes.Buffer
+	if err := testReport().WriteCSV(&b); err != nil {
+		t.Fatal(err)
+	}
+	want := `metric,name,count,min_ms,mean_ms,p50_ms,p90_ms,p99_ms,max_ms
+latency,catalog,1,0.250,0.250,0.250,0.250,0.250,0.250
+latency,register,2,1.000,1.500,1.000,2.000,2.000,2.000
+response,keepalive 408,1
+response,register 200,2
+response,register 401,2
+`
+	if b.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", b.String(), want)
+	}
+}
+
+func TestWriteJSON(t *testing.T) {
+	var b bytes.Buffer
+	if err := testReport().WriteJSON(&b); err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]interface{}
+	if err := json.Unmarshal(b.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	reg := got["latency"].(map[string]interface{})[Register].(map[string]interface{})
+	if reg["count"] != 2.0 || reg["meanMs"] != 1.5 || reg["p99Ms"] != 2.0 {
+		t.Errorf("register latency %v", reg)
+	}
+	if n := got["responses"].(map[string]interface{})[Keepalive].(map[string]interface{})["408"]; n != 1.0 {
+		t.Errorf("keepalive 408 = %v, want 1", n)
+	}
+	if got["durationSec"] != 10.0 || got["start"] != "2020-01-02T03:04:05Z" {
+		t.Errorf("durationSec %v, start %v", got["durationSec"], got["start"])
+	}
+	if n := got["counters"].(map[string]interface{})[RegisteredDevices]; n != 1.0 {
+		t.Errorf("%s = %v, want 1", RegisteredDevices, n)
+	}
+}
+
+// WriteFile picks the format by extension.
+func TestWriteFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sim-stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"report.csv", "report.CSV", "report.json", "report"} {
+		path := filepath.Join(dir, name)
+		if err := testReport().WriteFile(path); err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		csv := strings.HasPrefix(string(data), "metric,name,")
+		if want := strings.EqualFold(filepath.Ext(name), ".csv"); csv != want {
+			t.Errorf("%s: csv %v, want %v", name, csv, want)
+		}
+	}
+}
+
+// Snapshot leaves out histograms without samples and names counters with
+// their labels.
+func TestSnapshot(t *testing.T) {
+	defer useRegistry()()
+	Response(Register, 401, time.Millisecond)
+	Response(Register, 200, time.Millisecond*3)
+	Timeout(Keepalive)
+	RTPSent("udp", 100)
+
+	r := Snapshot()
+	if _, ok := r.Latency[Keepalive]; ok {
+		t.Error("keepalive latency without samples")
+	}
+	if s := r.Latency[Register]; s.Count != 2 || s.Min != 1 || s.Mean != 2 || s.Max != 3 {
+		t.Errorf("register latency %+v", s)
+	}
+	if r.Responses[Register][401] != 1 || r.Responses[Register][200] != 1 || r.Responses[Keepalive][408] != 1 {
+		t.Errorf("responses %v", r.Responses)
+	}
+	if n := r.Counters[`gbsim_rtp_bytes_sent_total{mode="udp"}`]; n != 100 {
+		t.Errorf("rtp bytes = %d, want 100", n)
+	}
+}
@@ -0,0 +1,224 @@
+package stats
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jart/gosip/sip"
+)
+
+// Latencies measured by the simulator. Register, Keepalive and Catalog are
+// the round-trip times of our requests, InviteToRTP is the time from an
+// incoming INVITE to the first RTP packet we send.
+const (
+	Register    = "register"
+	Keepalive   = "keepalive"
+	Catalog     = "catalog"
+	InviteToRTP = "invite_to_rtp"
+)
+
+// Counters and gauges, named as they are exposed on /metrics.
+const (
+	RegisteredDevices = "gbsim_registered_devices"
+	ActiveSessions    = "gbsim_active_sessions"
+	// labels: mode
+	RTPPackets = "gbsim_rtp_packets_sent_total"
+	RTPBytes   = "gbsim_rtp_bytes_sent_total"
+	// labels: direction, method, status (empty for requests)
+	SIPMessages = "gbsim_sip_messages_total"
+	// labels: type
+	TransportErrors = "gbsim_transport_errors_total"
+)
+
+var cmdTypeRegexp = regexp.MustCompile(`<CmdType>(\w+)</CmdType>`)
+
+// Kind names the request a client transaction was started for: REGISTER, or
+// the CmdType of a MANSCDP MESSAGE.
+func Kind(req *sip.Msg) string {
+	if req.Method == sip.MethodRegister {
+		return Register
+	}
+	if req.Method == sip.MethodMessage && req.Payload != nil {
+		if m := cmdTypeRegexp.FindSubmatch(req.Payload.Data()); m != nil {
+			return strings.ToLower(string(m[1]))
+		}
+	}
+	return strings.ToLower(req.Method)
+}
+
+// histogram buckets grow by 25% from 1ms, the last one holds everything above
+// a minute
+var bounds = func() []time.Duration {
+	var b []time.Duration
+	for d := time.Millisecond; d < time.Minute; d += d / 4 {
+		b = append(b, d)
+	}
+	return append(b, time.Minute)
+}()
+
+// Histogram is a latency histogram with fixed exponential buckets, so that
+// millions of samples cost no more than a few.
+type Histogram struct {
+	counts []int64
+	n      int64
+	sum    time.Duration
+	min    time.Duration
+	max    time.Duration
+}
+
+func newHistogram() *Histogram {
+	return &Histogram{counts: make([]int64, len(bounds)+1)}
+}
+
+func (h *Histogram) observe(d time.Duration) {
+	h.counts[sort.Search(len(bounds), func(i int) bool { return bounds[i] >= d })]++
+	if h.n == 0 || d < h.min {
+		h.min = d
+	}
+	if d > h.max {
+		h.max = d
+	}
+	h.n++
+	h.sum += d
+}
+
+// quantile returns the upper bound of the bucket holding the q-th sample,
+// capped by the largest sample seen.
+func (h *Histogram) quantile(q float64) time.Duration {
+	rank := int64(q*float64(h.n) + 0.5)
+	if rank < 1 {
+		rank = 1
+	}
+	var seen int64
+	for i, c := range h.counts {
+		if seen += c; seen >= rank {
+			if i < len(bounds) && bounds[i] < h.max {
+				return bounds[i]
+			}
+			return h.max
+		}
+	}
+	return h.max
+}
+
+type metric struct {
+	gauge bool
+	// by rendered label set, e.g. `mode="udp"`
+	values map[string]int64
+}
+
+type registry struct {
+	mu    sync.Mutex
+	start time.Time
+	hists map[string]*Histogram
+	// final response status counts by request kind, 408 includes timeouts
+	codes   map[string]map[int]int64
+	metrics map[string]*metric
+}
+
+var std = &registry{
+	start: time.Now(),
+	hists: make(map[string]*Histogram),
+	codes: make(map[string]map[int]int64),
+	metrics: map[string]*metric{
+		// exposed as 0 before the first device registers
+		RegisteredDevices: {gauge: true, values: map[string]int64{"": 0}},
+		ActiveSessions:    {gauge: true, values: map[string]int64{"": 0}},
+	},
+}
+
+// Observe adds a latency sample.
+func Observe(name string, d time.Duration) {
+	std.mu.Lock()
+	defer std.mu.Unlock()
+	std.observe(name, d)
+}
+
+func (r *registry) observe(name string, d time.Duration) {
+	h, ok := r.hists[name]
+	if !ok {
+		h = newHistogram()
+		r.hists[name] = h
+	}
+	h.observe(d)
+}
+
+func (r *registry) count(kind string, status int) {
+	c, ok := r.codes[kind]
+	if !ok {
+		c = make(map[int]int64)
+		r.codes[kind] = c
+	}
+	c[status]++
+}
+
+// Response records the final response to one of our requests and its
+// round-trip time.
+func Response(kind string, status int, rtt time.Duration) {
+	std.mu.Lock()
+	defer std.mu.Unlock()
+	std.count(kind, status)
+	std.observe(kind, rtt)
+}
+
+// Timeout records a request that got no response, counted as a 408 with no
+// latency sample.
+func Timeout(kind string) {
+	std.mu.Lock()
+	defer std.mu.Unlock()
+	std.count(kind, 408)
+}
+
+// Add adds delta to a counter, labels are name/value pairs.
+func Add(name string, delta int64, labels ...string) {
+	std.add(name, false, delta, labels)
+}
+
+// AddGauge adds delta, which may be negative, to a gauge.
+func AddGauge(name string, delta int64, labels ...string) {
+	std.add(name, true, delta, labels)
+}
+
+func (r *registry) add(name string, gauge bool, delta int64, labels []string) {
+	var b strings.Builder
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(labels[i])
+		b.WriteString("=")
+		b.WriteString(strconv.Quote(labels[i+1]))
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	m, ok := r.metrics[name]
+	if !ok {
+		m = &metric{gauge: gauge, values: make(map[string]int64)}
+		r.metrics[name] = m
+	}
+	m.values[b.String()] += delta
+}
+
+// SIPMessage counts a message we sent ("out") or received ("in").
+func SIPMessage(direction string, m *sip.Msg) {
+	if m.IsResponse() {
+		Add(SIPMessages, 1, "direction", direction, "method", m.CSeqMethod, "status", strconv.Itoa(m.Status))
+		return
+	}
+	Add(SIPMessages, 1, "direction", direction, "method", m.Method, "status", "")
+}
+
+// TransportError counts a failed read, write, parse or connect.
+func TransportError(typ string) {
+	Add(TransportErrors, 1, "type", typ)
+}
+
+// RTPSent counts one rtp packet of n bytes sent in the given transfer mode.
+func RTPSent(mode string, n int) {
+	Add(RTPPackets, 1, "mode", mode)
+	Add(RTPBytes, int64(n), "mode", mode)
+}
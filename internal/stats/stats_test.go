@@ -0,0 +1,60 @@
+package stats
+
+import (
+	"testing"
+	"time"
+)
+
+// useRegistry swaps in an empty registry for the test and returns the
+// function restoring the process one.
+func useRegistry() func() {
+	old := std
+	std = &registry{
+		start:   time.Now(),
+		hists:   make(map[string]*Histogram),
+		codes:   make(map[string]map[int]int64),
+		metrics: make(map[string]*metric),
+	}
+	return func() { std = old }
+}
+
+func TestQuantile(t *testing.T) {
+	tests := []struct {
+		name    string
+		samples []time.Duration
+		q       float64
+		want    time.Duration
+	}{
+		{"empty", nil, 0.5, 0},
+		{"empty p99", nil, 0.99, 0},
+		{"one sample p0", []time.Duration{time.Millisecond * 7}, 0, time.Millisecond * 7},
+		{"one sample p50", []time.Duration{time.Millisecond * 7}, 0.5, time.Millisecond * 7},
+		{"one sample p99", []time.Duration{time.Millisecond * 7}, 0.99, time.Millisecond * 7},
+		// the bound of the bucket, 1.25^4ms, not the sample
+		{"p50 is a bucket bound", []time.Duration{time.Millisecond, time.Millisecond * 2, time.Millisecond * 10}, 0.5, bounds[4]},
+		{"max caps the bucket", []time.Duration{time.Millisecond, time.Millisecond * 2, time.Millisecond * 10}, 0.99, time.Millisecond * 10},
+		{"below the first bound", []time.Duration{time.Microsecond, time.Microsecond * 2}, 0.5, time.Microsecond * 2},
+		{"above a minute", []time.Duration{time.Minute * 2}, 0.5, time.Minute * 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newHistogram()
+			for _, d := range tt.samples {
+				h.observe(d)
+			}
+			if got := h.quantile(tt.q); got != tt.want {
+				t.Errorf("quantile(%v) = %v, want %v", tt.q, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestObserve(t *testing.T) {
+	defer useRegistry()()
+	Observe(Register, time.Millisecond*3)
+	Observe(Register, time.Millisecond)
+	h := std.hists[Register]
+	if h.n != 2 || h.sum != time.Millisecond*4 || h.min != time.Millisecond || h.max != time.Millisecond*3 {
+		t.Errorf("n %d, sum %v, min %v, max %v, want 2, 4ms, 1ms, 3ms", h.n, h.sum, h.min, h.max)
+	}
+}
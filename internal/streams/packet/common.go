@@ -12,9 +12,11 @@ const (
 
 //
 const (
-	StreamTypeH264 = 0x1b
-	StreamTypeH265 = 0x24
-	StreamTypeAAC  = 0x90
+	StreamTypeH264  = 0x1b
+	StreamTypeH265  = 0x24
+	StreamTypeAAC   = 0x0f
+	StreamTypeG711A = 0x90
+	StreamTypeG711U = 0x91
 )
 
 //
@@ -4,6 +4,12 @@ type encPSPacket struct {
 	crc32 uint64
 }
 
+// psStream is an elementary stream listed in the system header and the PSM.
+type psStream struct {
+	id  int
+	typ int
+}
+
 /*
 	https://github.com/videolan/vlc/tree/master/modules/mux/mpeg
 */
@@ -29,61 +35,70 @@ func (enc *encPSPacket) encPackHeader(pts uint64) []byte {
 	return bits.pData
 }
 
-func (enc *encPSPacket) encSystemHeader(data []byte, vrates, arates int) []byte {
-	pack := make([]byte, SystemHeaderLength)
-	bits := bitsInit(SystemHeaderLength, pack)
+func (enc *encPSPacket) encSystemHeader(data []byte, streams []psStream, vrates, arates int) []byte {
+	var video, audio int
+	for _, s := range streams {
+		if s.id == StreamIDVideo {
+			video++
+		} else {
+			audio++
+		}
+	}
+	size := SystemHeaderLength + 3*(len(streams)-2)
+	pack := make([]byte, size)
+	bits := bitsInit(size, pack)
 	bitsWrite(bits, 32, StartCodeSYS)
-	bitsWrite(bits, 16, uint64(SystemHeaderLength-6))
+	bitsWrite(bits, 16, uint64(size-6))
 	bitsWrite(bits, 1, 1)
 	bitsWrite(bits, 22, 40960)
 	bitsWrite(bits, 1, 1)
-	bitsWrite(bits, 6, 1)
+	bitsWrite(bits, 6, uint64(audio))
 	bitsWrite(bits, 1, 0)
 	bitsWrite(bits, 1, 0)
 	bitsWrite(bits, 1, 0)
 	bitsWrite(bits, 1, 0)
 	bitsWrite(bits, 1, 1)
-	bitsWrite(bits, 5, 1)
+	bitsWrite(bits, 5, uint64(video))
 	bitsWrite(bits, 1, 1)
 	bitsWrite(bits, 7, 0xff)
 
-	// video stream bound
-	bitsWrite(bits, 8, 0xe0)
-	bitsWrite(bits, 2, 3)
-	bitsWrite(bits, 1, 1)
-	bitsWrite(bits, 13, uint64(vrates))
-
-	// audio stream bound
-	bitsWrite(bits, 8, 0xc0) // 0xc0 音频
-	bitsWrite(bits, 2, 0x03)
-	bitsWrite(bits, 1, 0)
-	bitsWrite(bits, 13, uint64(arates))
+	for _, s := range streams {
+		bitsWrite(bits, 8, uint64(s.id))
+		bitsWrite(bits, 2, 3)
+		if s.id == StreamIDVideo {
+			// video stream bound
+			bitsWrite(bits, 1, 1)
+			bitsWrite(bits, 13, uint64(vrates))
+		} else {
+			// audio stream bound
+			bitsWrite(bits, 1, 0)
+			bitsWrite(bits, 13, uint64(arates))
+		}
+	}
 
 	return append(data, bits.pData...)
 }
 
-func (enc *encPSPacket) encProgramStreamMap(data []byte) []byte {
+func (enc *encPSPacket) encProgramStreamMap(data []byte, streams []psStream) []byte {
 
-	pack := make([]byte, MAPHeaderLength)
-	bits := bitsInit(MAPHeaderLength, pack)
+	size := MAPHeaderLength + 4*(len(streams)-2)
+	pack := make([]byte, size)
+	bits := bitsInit(size, pack)
 	bitsWrite(bits, 32, StartCodeMAP)
-	bitsWrite(bits, 16, uint64(MAPHeaderLength-6))
+	bitsWrite(bits, 16, uint64(size-6))
 	bitsWrite(bits, 1, 1)
 	bitsWrite(bits, 2, 0xf)
 	bitsWrite(bits, 5, 0)
 	bitsWrite(bits, 7, 0xff)
 	bitsWrite(bits, 1, 1)
 	bitsWrite(bits, 16, 0)
-	bitsWrite(bits, 16, 8)
+	bitsWrite(bits, 16, uint64(4*len(streams)))
 
-	//video
-	bitsWrite(bits, 8, StreamTypeH264)
-	bitsWrite(bits, 8, StreamIDVideo)
-	bitsWrite(bits, 16, 0)
-	// audio
-	bitsWrite(bits, 8, StreamTypeAAC) // 0x90 G711
-	bitsWrite(bits, 8, StreamIDAudio) // 0x0c0 音频取值（0xc0-0xdf），通常为0xc0
-	bitsWrite(bits, 16, 0)
+	for _, s := range streams {
+		bitsWrite(bits, 8, uint64(s.typ))
+		bitsWrite(bits, 8, uint64(s.id)) // 视频 0xe0,音频取值（0xc0-0xdf），通常为0xc0
+		bitsWrite(bits, 16, 0)
+	}
 
 	bitsWrite(bits, 8, enc.crc32>>24) // CRC_32 : (32) CRC 32字段
 	bitsWrite(bits, 8, (enc.crc32>>16)&0xFF)
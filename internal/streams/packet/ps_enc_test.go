@@ -0,0 +1,78 @@
+package packet
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// The PSM and the system header list the streams set with SetStreams.
+func TestStreamList(t *testing.T) {
+	tests := []struct {
+		name         string
+		video, audio int
+		want         []psStream
+	}{
+		// -1: SetStreams not called
+		{"default", -1, -1, []psStream{{StreamIDVideo, StreamTypeH264}}},
+		{"h265", StreamTypeH265, 0, []psStream{{StreamIDVideo, StreamTypeH265}}},
+		{"h264 and g711a", StreamTypeH264, StreamTypeG711A, []psStream{{StreamIDVideo, StreamTypeH264}, {StreamIDAudio, StreamTypeG711A}}},
+		{"h264 and g711u", StreamTypeH264, StreamTypeG711U, []psStream{{StreamIDVideo, StreamTypeH264}, {StreamIDAudio, 0x91}}},
+		{"h265 and aac", StreamTypeH265, StreamTypeAAC, []psStream{{StreamIDVideo, StreamTypeH265}, {StreamIDAudio, 0x0f}}},
+		{"audio alone", 0, StreamTypeG711U, []psStream{{StreamIDAudio, 0x91}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rtp := NewRRtpTransfer("", UDPTransfer, 1)
+			if tt.video >= 0 {
+				rtp.SetStreams(tt.video, tt.audio)
+			}
+			enc := &encPSPacket{}
+
+			psm := enc.encProgramStreamMap(nil, rtp.streams)
+			if n := int(binary.BigEndian.Uint16(psm[4:])); n != len(psm)-6 {
+				t.Errorf("psm length %d, want %d", n, len(psm)-6)
+			}
+			infoLen := int(binary.BigEndian.Uint16(psm[8:]))
+			mapLen := int(binary.BigEndian.Uint16(psm[10+infoLen:]))
+			entries := psm[12+infoLen : 12+infoLen+mapLen]
+			var got []psStream
+			for len(entries) >= 4 {
+				got = append(got, psStream{id: int(entries[1]), typ: int(entries[0])})
+				entries = entries[4+int(binary.BigEndian.Uint16(entries[2:])):]
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("psm streams %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("psm stream %d = %+v, want %+v", i, got[i], tt.want[i])
+				}
+			}
+			// crc follows the map
+			if rest := len(psm) - (12 + infoLen + mapLen); rest != 4 {
+				t.Errorf("%d bytes after the stream map, want the crc", rest)
+			}
+
+			sys := enc.encSystemHeader(nil, rtp.streams, 0, 0)
+			if n := int(binary.BigEndian.Uint16(sys[4:])); n != len(sys)-6 {
+				t.Errorf("system header length %d, want %d", n, len(sys)-6)
+			}
+			var audio, video int
+			for _, s := range tt.want {
+				if s.id == StreamIDVideo {
+					video++
+				} else {
+					audio++
+				}
+			}
+			if a, v := int(sys[9]>>2), int(sys[10]&0x1f); a != audio || v != video {
+				t.Errorf("system header audio/video bound %d/%d, want %d/%d", a, v, audio, video)
+			}
+			for i, s := range tt.want {
+				if id := int(sys[12+3*i]); id != s.id {
+					t.Errorf("system header stream %d id %#x, want %#x", i, id, s.id)
+				}
+			}
+		})
+	}
+}
@@ -2,26 +2,47 @@ package packet
 
 import (
 	"errors"
-	"fmt"
 	"net"
 	"os"
 	"strconv"
 	"time"
 
+	"github.com/lzh2nix/gb28181Simulator/internal/stats"
 	"github.com/qiniu/x/xlog"
 )
 
 var log *xlog.Logger
 
+// dataTimeout is how long the write routine waits for the next packet before
+// it gives up on the transfer, a variable so that tests can shorten it.
+var dataTimeout = time.Second * 5
+
 func init() {
 	log = xlog.New("streams")
 }
 
+// PayloadTypePS is the dynamic rtp payload type GB28181 uses for ps.
+const PayloadTypePS = 96
+
+// ClockRate is the 90kHz clock of the ps and rtp timestamps.
+const ClockRate = 90000
+
+// Timestamp converts a time from the start of the stream to the nearest tick
+// of the 90kHz clock, wrapped to the 33 bits of a ps timestamp. The rtp
+// header carries its low 32 bits, so it wraps there.
+func Timestamp(d time.Duration) uint64 {
+	sec, rem := uint64(d/time.Second), uint64(d%time.Second)
+	ts := sec*ClockRate + (rem*ClockRate+uint64(time.Second)/2)/uint64(time.Second)
+	return ts & (1<<33 - 1)
+}
+
 // RtpTransfer ...
 type RtpTransfer struct {
 	datasrc      string
 	protocol     int // tcp or udp
 	psEnc        *encPSPacket
+	streams      []psStream
+	payloadType  int
 	payload      chan []byte
 	cseq         uint16
 	ssrc         uint32
@@ -29,22 +50,26 @@ type RtpTransfer struct {
 	tcpconn      net.Conn
 	writestop    chan bool
 	quit         chan bool
-	timerProcess *time.Ticker
+	done         chan struct{} // closed when the write routine exits
+	timerProcess *time.Timer   // restarted by every packet written
 	Stop         bool
 }
 
 func NewRRtpTransfer(src string, pro int, ssrc int) *RtpTransfer {
 
 	return &RtpTransfer{
-		datasrc:   src,
-		protocol:  pro,
-		psEnc:     &encPSPacket{},
-		payload:   make(chan []byte, 25),
-		cseq:      0,
-		ssrc:      uint32(ssrc),
-		writestop: make(chan bool, 1),
-		quit:      make(chan bool, 1),
-		Stop:      false,
+		datasrc:     src,
+		protocol:    pro,
+		psEnc:       &encPSPacket{},
+		streams:     []psStream{{StreamIDVideo, StreamTypeH264}},
+		payloadType: PayloadTypePS,
+		payload:     make(chan []byte, 25),
+		cseq:        0,
+		ssrc:        uint32(ssrc),
+		writestop:   make(chan bool, 1),
+		quit:        make(chan bool, 1),
+		done:        make(chan struct{}),
+		Stop:        false,
 	}
 }
 
@@ -52,11 +77,11 @@ func NewRRtpTransfer(src string, pro int, ssrc int) *RtpTransfer {
 func (rtp *RtpTransfer) Service(srcip, dstip string, srcport, dstport int) error {
 
 	if nil == rtp.timerProcess {
-		rtp.timerProcess = time.NewTicker(time.Second * time.Duration(5))
+		rtp.timerProcess = time.NewTimer(dataTimeout)
 	}
 	if rtp.protocol == TCPTransferPassive {
-		go rtp.write4tcppassive(srcip+":"+strconv.Itoa(srcport),
-			dstip+":"+strconv.Itoa(dstport))
+		go rtp.write4tcppassive(net.JoinHostPort(srcip, strconv.Itoa(srcport)),
+			net.JoinHostPort(dstip, strconv.Itoa(dstport)))
 
 	} else if rtp.protocol == TCPTransferActive {
 		// connect to to dst ip port
@@ -95,21 +120,52 @@ func (rtp *RtpTransfer) Exit() {
 	<-rtp.quit
 }
 
-func (rtp *RtpTransfer) Send2data(data []byte, key bool, pts uint64) {
-	psSys := rtp.psEnc.encPackHeader(pts)
+// SetStreams sets the stream types the system header and the PSM list, 0 for
+// a stream the source doesn't have. The default is h264 video alone.
+func (rtp *RtpTransfer) SetStreams(video, audio int) {
+	rtp.streams = nil
+	if video != 0 {
+		rtp.streams = append(rtp.streams, psStream{StreamIDVideo, video})
+	}
+	if audio != 0 {
+		rtp.streams = append(rtp.streams, psStream{StreamIDAudio, audio})
+	}
+}
+
+// SetPayloadType sets the rtp payload type, the one the platform offered for
+// ps in the INVITE.
+func (rtp *RtpTransfer) SetPayloadType(pt int) {
+	rtp.payloadType = pt
+}
+
+// Send2data muxes one frame of raw video into ps and sends it, it reports
+// true once the transfer has stopped. pts and dts are 90kHz timestamps, the
+// pack and rtp timestamps follow the decode time dts.
+func (rtp *RtpTransfer) Send2data(data []byte, key bool, pts, dts uint64) bool {
+	return rtp.sendPES(data, StreamIDVideo, key, pts, dts)
+}
+
+// SendAudio muxes one audio frame into a ps pack of its own and sends it.
+func (rtp *RtpTransfer) SendAudio(data []byte, pts uint64) bool {
+	return rtp.sendPES(data, StreamIDAudio, false, pts, pts)
+}
+
+func (rtp *RtpTransfer) sendPES(data []byte, streamID int, key bool, pts, dts uint64) bool {
+	psSys := rtp.psEnc.encPackHeader(dts)
 	if key { // just I frame will add this
-		psSys = rtp.psEnc.encSystemHeader(psSys, 2048, 512)
-		psSys = rtp.psEnc.encProgramStreamMap(psSys)
+		psSys = rtp.psEnc.encSystemHeader(psSys, rtp.streams, 2048, 512)
+		psSys = rtp.psEnc.encProgramStreamMap(psSys, rtp.streams)
 	}
 
 	lens := len(data)
 	var index int
 	for lens > 0 {
 		pesload := lens
-		if pesload > PESLoadLength {
-			pesload = PESLoadLength
+		// PES_packet_length counts the 13 header bytes after it as well
+		if pesload > PESLoadLength-(PESHeaderLength-6) {
+			pesload = PESLoadLength - (PESHeaderLength - 6)
 		}
-		pes := rtp.psEnc.encPESPacket(data[index:index+pesload], StreamIDVideo, pesload, pts, pts)
+		pes := rtp.psEnc.encPESPacket(data[index:index+pesload], streamID, pesload, pts, dts)
 
 		// every frame add ps header
 		if index == 0 {
@@ -119,17 +175,20 @@ func (rtp *RtpTransfer) Send2data(data []byte, key bool, pts uint64) {
 		// over the max pes len and split more pes load slice
 		index += pesload
 		lens -= pesload
-		if lens > 0 {
-			rtp.fragmentation(pes, pts, 0)
-		} else {
+		last := 0
+		if lens == 0 {
 			// the last slice
-			rtp.fragmentation(pes, pts, 1)
-
+			last = 1
+		}
+		if rtp.fragmentation(pes, dts, last) {
+			return true
 		}
 	}
-
+	return false
 }
 
+// SendPSdata sends a pack of a pre-muxed ps stream as is, pts is the 90kHz
+// rtp timestamp.
 func (rtp *RtpTransfer) SendPSdata(data []byte, key bool, pts uint64) bool {
 	lens := len(data)
 	var index int
@@ -172,7 +231,9 @@ func (rtp *RtpTransfer) fragmentation(data []byte, pts uint64, last int) bool {
 		//	return true
 		//}
 		payload := rtp.encRtpHeader(data[:], 1, pts)
-		rtp.payload <- payload
+		if !rtp.push(payload) {
+			return true
+		}
 	} else {
 		marker := 0
 		var index int
@@ -186,13 +247,32 @@ func (rtp *RtpTransfer) fragmentation(data []byte, pts uint64, last int) bool {
 			//if rtp.Stop {
 			//	return true
 			//}
-			rtp.payload <- payload
+			if !rtp.push(payload) {
+				return true
+			}
 			datalen -= sendlen
 			index += sendlen
 		}
 	}
 	return false
 }
+
+// push queues a packet for the write routine, false once it has exited.
+func (rtp *RtpTransfer) push(payload []byte) bool {
+	// the queue may have room left after the routine exited
+	select {
+	case <-rtp.done:
+		return false
+	default:
+	}
+	select {
+	case rtp.payload <- payload:
+		return true
+	case <-rtp.done:
+		return false
+	}
+}
+
 func (rtp *RtpTransfer) encRtpHeader(data []byte, marker int, curpts uint64) []byte {
 
 	if rtp.protocol == LocalCache {
@@ -206,7 +286,7 @@ func (rtp *RtpTransfer) encRtpHeader(data []byte, marker int, curpts uint64) []b
 	bitsWrite(bits, 1, 0)
 	bitsWrite(bits, 4, 0)
 	bitsWrite(bits, 1, uint64(marker))
-	bitsWrite(bits, 7, 96)
+	bitsWrite(bits, 7, uint64(rtp.payloadType))
 	bitsWrite(bits, 16, uint64(rtp.cseq))
 	bitsWrite(bits, 32, curpts)
 	bitsWrite(bits, 32, uint64(rtp.ssrc))
@@ -221,6 +301,17 @@ func (rtp *RtpTransfer) encRtpHeader(data []byte, marker int, curpts uint64) []b
 
 }
 
+// resetTimeout restarts the timer of the write routine.
+func (rtp *RtpTransfer) resetTimeout() {
+	if !rtp.timerProcess.Stop() {
+		select {
+		case <-rtp.timerProcess.C:
+		default:
+		}
+	}
+	rtp.timerProcess.Reset(dataTimeout)
+}
+
 func (rtp *RtpTransfer) write4udp() {
 
 	log.Infof("write4udp stream data will be write by(udp)")
@@ -234,6 +325,8 @@ func (rtp *RtpTransfer) write4udp() {
 						log.Errorf("write data by udp error(%v), len(%v).", err, lens)
 						goto UDPSTOP
 					}
+					stats.RTPSent("udp", lens)
+					rtp.resetTimeout()
 				}
 			} else {
 				log.Error("rtp data channel closed")
@@ -250,6 +343,7 @@ func (rtp *RtpTransfer) write4udp() {
 UDPSTOP:
 	rtp.udpconn.Close()
 	rtp.Stop = true
+	close(rtp.done)
 	rtp.quit <- true
 }
 
@@ -259,17 +353,39 @@ func (rtp *RtpTransfer) write4tcppassive(srcaddr, dstaddr string) {
 	addr, err := net.ResolveTCPAddr("tcp", srcaddr)
 	if err != nil {
 		log.Errorf("net.ResolveTCPAddr error(%v).", err)
+		close(rtp.done)
+		rtp.quit <- true
 		return
 	}
 	listener, err := net.ListenTCP("tcp", addr)
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			continue
+	if err != nil {
+		log.Errorf("net.ListenTCP error(%v).", err)
+		close(rtp.done)
+		rtp.quit <- true
+		return
+	}
+	defer listener.Close()
+	// the platform may never connect, give up after the data timeout or
+	// once the transfer is stopped
+	listener.SetDeadline(time.Now().Add(dataTimeout))
+	accepted := make(chan struct{})
+	go func() {
+		select {
+		case <-rtp.writestop:
+			listener.Close()
+		case <-accepted:
 		}
-		rtp.tcpconn = conn
-		break
+	}()
+	conn, err := listener.Accept()
+	close(accepted)
+	if err != nil {
+		log.Errorf("accept tcp connection error(%v).", err)
+		close(rtp.done)
+		rtp.quit <- true
+		return
 	}
+	rtp.tcpconn = conn
+	rtp.resetTimeout()
 	for {
 		if rtp.tcpconn == nil {
 			goto TCPPASSIVESTOP
@@ -277,11 +393,14 @@ func (rtp *RtpTransfer) write4tcppassive(srcaddr, dstaddr string) {
 		select {
 		case data, ok := <-rtp.payload:
 			if ok {
+				rtp.tcpconn.SetWriteDeadline(time.Now().Add(dataTimeout))
 				lens, err := rtp.tcpconn.Write(data)
 				if err != nil || lens != len(data) {
 					log.Errorf("write data by tcp error(%v), len(%v).", err, lens)
 					goto TCPPASSIVESTOP
 				}
+				stats.RTPSent("tcp_passive", lens)
+				rtp.resetTimeout()
 
 			} else {
 				log.Errorf("data channel closed")
@@ -297,6 +416,7 @@ func (rtp *RtpTransfer) write4tcppassive(srcaddr, dstaddr string) {
 	}
 TCPPASSIVESTOP:
 	rtp.tcpconn.Close()
+	close(rtp.done)
 	rtp.quit <- true
 }
 
@@ -304,25 +424,31 @@ func (rtp *RtpTransfer) write4tcpactive(dstaddr string, port int) {
 
 	log.Infof("write4tcpactive stream data will be write by(tcp)")
 	var err error
-	rtp.tcpconn, err = net.Dial("tcp", fmt.Sprintf("%s:%d", dstaddr, port))
+	rtp.tcpconn, err = net.DialTimeout("tcp", net.JoinHostPort(dstaddr, strconv.Itoa(port)), time.Second*5)
 	if err != nil {
-		log.Fatalln(err)
-	} else {
-		log.Println("tcp connet to", dstaddr, ":", port, "success", rtp.tcpconn.LocalAddr().String())
+		log.Error("tcp connect to", dstaddr, ":", port, "failed", err)
+		rtp.Stop = true
+		close(rtp.done)
+		rtp.quit <- true
+		return
 	}
+	log.Println("tcp connet to", dstaddr, ":", port, "success", rtp.tcpconn.LocalAddr().String())
 	defer func() {
 		log.Println("write4tcpactive routine exit, ", rtp.tcpconn.LocalAddr().String())
 		rtp.tcpconn.Close()
+		close(rtp.done)
 		rtp.quit <- true
 	}()
 
+	// closed when the peer closes the connection
+	peerClosed := make(chan bool)
 	go func() {
 		buf := make([]byte, 1024)
 		for {
 			_, err := rtp.tcpconn.Read(buf)
 			if err != nil {
 				log.Error("tcp read error", err, rtp.tcpconn.LocalAddr().String())
-				rtp.writestop <- true
+				close(peerClosed)
 				return
 			}
 			log.Println("tcp recv rtp data", rtp.tcpconn.LocalAddr().String(), "len", len(buf), "data:", string(buf))
@@ -334,11 +460,14 @@ func (rtp *RtpTransfer) write4tcpactive(dstaddr string, port int) {
 		select {
 		case data, ok := <-rtp.payload:
 			if ok {
+				// a platform that stops reading must not block the routine
+				rtp.tcpconn.SetWriteDeadline(time.Now().Add(dataTimeout))
 				lens, err := rtp.tcpconn.Write(data)
 				if err != nil || lens != len(data) {
 					log.Error("write data by tcp error", err, lens, len(data), rtp.tcpconn.LocalAddr().String())
 					goto end
 				}
+				stats.RTPSent("tcp_active", lens)
 				if count%6000 == 0 {
 					log.Println("already send", count, "rtp pkts", rtp.tcpconn.LocalAddr().String())
 				}
@@ -346,8 +475,11 @@ func (rtp *RtpTransfer) write4tcpactive(dstaddr string, port int) {
 
 			} else {
 				log.Errorf("data channel closed")
-				break
+				goto end
 			}
+		case <-peerClosed:
+			log.Error("tcp rtp peer closed")
+			goto end
 		case <-rtp.writestop:
 			log.Error("tcp rtp send channel stop")
 			goto end
@@ -363,6 +495,8 @@ func (rtp *RtpTransfer) write4file() {
 	files, err := os.OpenFile("./test.dat", os.O_CREATE|os.O_WRONLY, 0666)
 	if err != nil {
 		log.Errorf("open test.dat file err(%v", err)
+		close(rtp.done)
+		rtp.quit <- true
 		return
 	}
 
@@ -387,5 +521,6 @@ func (rtp *RtpTransfer) write4file() {
 	}
 FILESTOP:
 	files.Close()
+	close(rtp.done)
 	rtp.quit <- true
 }
@@ -0,0 +1,181 @@
+package packet
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// A udp transfer keeps going as long as packets come in time and stops once
+// they don't.
+func TestUDPTransferTimeout(t *testing.T) {
+	defer func(d time.Duration) { dataTimeout = d }(dataTimeout)
+	dataTimeout = time.Millisecond * 100
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	received := make(chan int, 100)
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			if _, err := conn.Read(buf); err != nil {
+				return
+			}
+			received <- 1
+		}
+	}()
+
+	rtp := NewRRtpTransfer("", UDPTransfer, 1)
+	if err := rtp.Service("127.0.0.1", "127.0.0.1", 0, conn.LocalAddr().(*net.UDPAddr).Port); err != nil {
+		t.Fatal(err)
+	}
+	defer rtp.Exit()
+	// five timeouts worth of packets
+	for i := 0; i < 25; i++ {
+		if rtp.SendPSdata([]byte{0, 0, 1, 0xba}, false, uint64(i)*3600) {
+			t.Fatalf("transfer stopped after %d packets", i)
+		}
+		time.Sleep(dataTimeout / 5)
+	}
+	for i := 0; i < 25; i++ {
+		select {
+		case <-received:
+		case <-time.After(time.Second):
+			t.Fatalf("%d packets received, want 25", i)
+		}
+	}
+
+	select {
+	case <-rtp.done:
+	case <-time.After(dataTimeout * 10):
+		t.Fatal("transfer still running without packets")
+	}
+	if !rtp.SendPSdata([]byte{0, 0, 1, 0xba}, false, 0) {
+		t.Error("send after the timeout = false, want the transfer stopped")
+	}
+}
+
+// freeTCPPort returns a port nothing listens on.
+func freeTCPPort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// A passive transfer the platform never connects to gives up after the data
+// timeout, and Exit doesn't wait for it.
+func TestTCPPassiveNoConnection(t *testing.T) {
+	defer func(d time.Duration) { dataTimeout = d }(dataTimeout)
+	dataTimeout = time.Millisecond * 100
+
+	rtp := NewRRtpTransfer("", TCPTransferPassive, 1)
+	if err := rtp.Service("127.0.0.1", "127.0.0.1", freeTCPPort(t), 0); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-rtp.done:
+	case <-time.After(time.Second):
+		t.Fatal("transfer still waiting for a connection")
+	}
+	rtp.Exit()
+
+	dataTimeout = time.Hour
+	port := freeTCPPort(t)
+	rtp = NewRRtpTransfer("", TCPTransferPassive, 1)
+	if err := rtp.Service("127.0.0.1", "127.0.0.1", port, 0); err != nil {
+		t.Fatal(err)
+	}
+	// let it listen
+	time.Sleep(time.Millisecond * 50)
+	exited := make(chan struct{})
+	go func() {
+		rtp.Exit()
+		close(exited)
+	}()
+	select {
+	case <-exited:
+	case <-time.After(time.Second):
+		t.Fatal("Exit blocked on accept")
+	}
+	// the port is free again
+	l, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		t.Fatalf("listener not closed: %v", err)
+	}
+	l.Close()
+}
+
+// An active transfer to a platform that stops reading stops once a write
+// can't complete within the data timeout.
+func TestTCPActiveWriteDeadline(t *testing.T) {
+	defer func(d time.Duration) { dataTimeout = d }(dataTimeout)
+	dataTimeout = time.Millisecond * 100
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	rtp := NewRRtpTransfer("", TCPTransferActive, 1)
+	if err := rtp.Service("127.0.0.1", "127.0.0.1", 0, l.Addr().(*net.TCPAddr).Port); err != nil {
+		t.Fatal(err)
+	}
+	defer rtp.Exit()
+	conn := <-accepted
+	defer conn.Close()
+
+	// never read, the socket buffers fill up
+	stopped := make(chan struct{})
+	go func() {
+		payload := make([]byte, 60000)
+		for !rtp.SendPSdata(payload, false, 0) {
+		}
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second * 10):
+		t.Fatal("transfer still writing to a peer that doesn't read")
+	}
+}
+
+func TestTimestamp(t *testing.T) {
+	// 2^33 ticks of the 90kHz clock
+	wrap := time.Duration(95443717688889)
+	tests := []struct {
+		name string
+		d    time.Duration
+		want uint64
+	}{
+		{"zero", 0, 0},
+		{"frame at 25fps", time.Millisecond * 40, 3600},
+		{"one second", time.Second, ClockRate},
+		{"tick", time.Second / ClockRate, 1},
+		{"below half a tick", time.Nanosecond * 5555, 0},
+		{"above half a tick", time.Nanosecond * 5556, 1},
+		{"one and a half ticks", time.Nanosecond * 16667, 2},
+		{"last tick before the wrap", wrap - time.Second/ClockRate, 1<<33 - 1},
+		{"wrap", wrap, 0},
+		{"after the wrap", wrap + time.Millisecond*40, 3600},
+		{"100 hours", time.Hour * 100, (100 * 3600 * ClockRate) % (1 << 33)},
+	}
+	for _, tt := range tests {
+		if got := Timestamp(tt.d); got != tt.want {
+			t.Errorf("%s: Timestamp(%v) = %d, want %d", tt.name, tt.d, got, tt.want)
+		}
+	}
+}
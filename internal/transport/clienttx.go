@@ -0,0 +1,214 @@
+package transport
+
+import (
+	"time"
+
+	"github.com/jart/gosip/sip"
+	"github.com/lzh2nix/gb28181Simulator/internal/stats"
+	"github.com/lzh2nix/gb28181Simulator/internal/version"
+	"github.com/qiniu/x/xlog"
+)
+
+// RFC 3261 §17.1.1.1 timer values, variables so that tests can shorten them
+var (
+	T1 = time.Millisecond * 500
+	T2 = time.Second * 4
+	T4 = time.Second * 5
+)
+
+const (
+	txCalling = iota // Calling for INVITE, Trying for the others
+	txProceeding
+	txCompleted
+	txConfirmed // server INVITE transaction only
+	txTerminated
+)
+
+// clientTx is a client transaction (RFC 3261 §17.1). It retransmits the
+// request over UDP (Timer A/E) until a response arrives and reports a 408
+// to the user agent when none arrives in time (Timer B/F).
+type clientTx struct {
+	key      string
+	req      *sip.Msg
+	data     []byte
+	reliable bool
+	state    int
+	start    time.Time
+	interval time.Duration
+	retrans  *time.Timer // Timer A / E
+	timeout  *time.Timer // Timer B / F, then Timer D / K once completed
+}
+
+func txKey(branch, method string) string {
+	return branch + " " + method
+}
+
+func (tr *Transport) startClientTx(xlog *xlog.Logger, req *sip.Msg, data []byte, reliable bool) {
+	branch := req.Via.Param.Get("branch")
+	if branch == nil || req.Method == sip.MethodAck {
+		return
+	}
+	tx := &clientTx{
+		key:      txKey(branch.Value, req.Method),
+		req:      req,
+		data:     data,
+		reliable: reliable,
+		state:    txCalling,
+		start:    time.Now(),
+		interval: T1,
+	}
+	tr.txMu.Lock()
+	defer tr.txMu.Unlock()
+	if old, ok := tr.clientTxs[tx.key]; ok {
+		old.stop()
+	}
+	tr.clientTxs[tx.key] = tx
+	if !reliable {
+		tx.retrans = time.AfterFunc(tx.interval, func() { tr.retransmitRequest(xlog, tx) })
+	}
+	tx.timeout = time.AfterFunc(64*T1, func() { tr.clientTxTimeout(xlog, tx) })
+}
+
+func (tx *clientTx) stop() {
+	if tx.retrans != nil {
+		tx.retrans.Stop()
+	}
+	tx.timeout.Stop()
+}
+
+func (tr *Transport) retransmitRequest(xlog *xlog.Logger, tx *clientTx) {
+	tr.txMu.Lock()
+	invite := tx.req.Method == sip.MethodInvite
+	if tx.state == txCalling || (tx.state == txProceeding && !invite) {
+		switch {
+		case invite:
+			tx.interval *= 2
+		case tx.state == txProceeding:
+			tx.interval = T2
+		default:
+			if tx.interval *= 2; tx.interval > T2 {
+				tx.interval = T2
+			}
+		}
+		tx.retrans.Reset(tx.interval)
+	} else {
+		tr.txMu.Unlock()
+		return
+	}
+	tr.txMu.Unlock()
+	xlog.Debugf("retransmit %s, callId:%s", tx.req.Method, tx.req.CallID)
+	tr.write(xlog, tx.data, nil)
+}
+
+func (tr *Transport) clientTxTimeout(xlog *xlog.Logger, tx *clientTx) {
+	tr.txMu.Lock()
+	state := tx.state
+	tx.state = txTerminated
+	if tr.clientTxs[tx.key] == tx {
+		delete(tr.clientTxs, tx.key)
+	}
+	tx.stop()
+	tr.txMu.Unlock()
+	if state == txCalling || state == txProceeding {
+		stats.Timeout(stats.Kind(tx.req))
+		xlog.Errorf("%s transaction timeout, callId:%s", tx.req.Method, tx.req.CallID)
+		tr.dispatch(xlog, timeoutResponse(tx.req))
+	}
+}
+
+// handleClientResponse feeds a response to its client transaction and
+// reports whether it was a retransmission that must not reach the user agent.
+func (tr *Transport) handleClientResponse(xlog *xlog.Logger, resp *sip.Msg) bool {
+	absorbed, ack := tr.clientResponse(resp)
+	if ack != nil {
+		// outside txMu, a blocked write must not hold up the timers
+		tr.write(xlog, ack, resp.SourceAddr)
+	}
+	return absorbed
+}
+
+// clientResponse moves the client transaction of resp on. It also returns
+// the ACK to send for a non-2xx final response to an INVITE.
+func (tr *Transport) clientResponse(resp *sip.Msg) (bool, []byte) {
+	branch := resp.Via.Param.Get("branch")
+	if branch == nil {
+		return false, nil
+	}
+	tr.txMu.Lock()
+	defer tr.txMu.Unlock()
+	tx, ok := tr.clientTxs[txKey(branch.Value, resp.CSeqMethod)]
+	if !ok {
+		return false, nil
+	}
+	invite := tx.req.Method == sip.MethodInvite
+	switch tx.state {
+	case txCompleted:
+		if invite {
+			return true, []byte(ackFor(tx.req, resp).String())
+		}
+		return true, nil
+	case txTerminated:
+		return true, nil
+	}
+	if resp.Status < 200 {
+		tx.state = txProceeding
+		if invite && tx.retrans != nil {
+			tx.retrans.Stop()
+		}
+		return false, nil
+	}
+	if tx.retrans != nil {
+		tx.retrans.Stop()
+	}
+	stats.Response(stats.Kind(tx.req), resp.Status, time.Since(tx.start))
+	if invite && resp.Status < 300 {
+		// the ACK for a 2xx belongs to the dialog, not to the transaction
+		tx.state = txTerminated
+		tx.timeout.Stop()
+		delete(tr.clientTxs, tx.key)
+		return false, nil
+	}
+	wait := T4 // Timer K
+	var ack []byte
+	if invite {
+		ack = []byte(ackFor(tx.req, resp).String())
+		wait = 64 * T1 // Timer D
+	}
+	if tx.reliable {
+		wait = 0
+	}
+	tx.state = txCompleted
+	tx.timeout.Reset(wait)
+	return false, ack
+}
+
+// timeoutResponse is the 408 the transaction layer hands to the user agent
+// when Timer B or F fires (RFC 3261 §8.1.3.1), or when Timer H ends a 2xx to
+// an INVITE that was never acknowledged.
+func timeoutResponse(req *sip.Msg) *sip.Msg {
+	return &sip.Msg{
+		Status:     408,
+		From:       req.From.Copy(),
+		To:         req.To.Copy(),
+		Via:        req.Via.Copy(),
+		CallID:     req.CallID,
+		CSeq:       req.CSeq,
+		CSeqMethod: req.Method,
+	}
+}
+
+// ackFor builds the ACK for a non-2xx final response to an INVITE
+// (RFC 3261 §17.1.1.3).
+func ackFor(req, resp *sip.Msg) *sip.Msg {
+	return &sip.Msg{
+		Method:     sip.MethodAck,
+		Request:    req.Request.Copy(),
+		Via:        req.Via.Detach(),
+		From:       req.From.Copy(),
+		To:         resp.To.Copy(),
+		CallID:     req.CallID,
+		CSeq:       req.CSeq,
+		CSeqMethod: sip.MethodAck,
+		UserAgent:  version.Version(),
+	}
+}
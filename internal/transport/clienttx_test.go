@@ -0,0 +1,229 @@
+package transport
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jart/gosip/sip"
+	"github.com/lzh2nix/gb28181Simulator/internal/config"
+	"github.com/qiniu/x/xlog"
+)
+
+// shortTimers runs a test with T1 10ms, T2 40ms and T4 50ms, Timer B/F/H
+// fire after 640ms then.
+func shortTimers() func() {
+	t1, t2, t4 := T1, T2, T4
+	T1, T2, T4 = time.Millisecond*10, time.Millisecond*40, time.Millisecond*50
+	return func() { T1, T2, T4 = t1, t2, t4 }
+}
+
+// peer is the platform side of a loopback udp pair.
+type peer struct {
+	t    *testing.T
+	conn *net.UDPConn
+	// the transport under test
+	to *net.UDPAddr
+}
+
+func newPair(t *testing.T) (*Transport, *peer) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr, err := StartSip(xlog.New("tx-test"), conn.LocalAddr().String(), "udp", &config.Config{})
+	if err != nil {
+		conn.Close()
+		t.Fatal(err)
+	}
+	_, port := tr.LocalAddr()
+	return tr, &peer{t: t, conn: conn, to: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}}
+}
+
+func (p *peer) send(msg string) {
+	if _, err := p.conn.WriteToUDP([]byte(msg), p.to); err != nil {
+		p.t.Fatal(err)
+	}
+}
+
+// recv returns the first line of the next message, "" if none arrives in d.
+func (p *peer) recv(d time.Duration) string {
+	p.conn.SetReadDeadline(time.Now().Add(d))
+	buf := make([]byte, sipMaxPacketSize)
+	n, _, err := p.conn.ReadFromUDP(buf)
+	if err != nil {
+		return ""
+	}
+	return strings.SplitN(string(buf[:n]), "\r\n", 2)[0]
+}
+
+// collect returns the first lines of the messages arriving in d.
+func (p *peer) collect(d time.Duration) []string {
+	var lines []string
+	end := time.Now().Add(d)
+	for {
+		left := time.Until(end)
+		if left <= 0 {
+			return lines
+		}
+		if line := p.recv(left); line != "" {
+			lines = append(lines, line)
+		}
+	}
+}
+
+func (p *peer) close() {
+	p.conn.Close()
+}
+
+func request(method, callID, branch string, cseq int) string {
+	return fmt.Sprintf("%s sip:34020000002000000001@3402000000 SIP/2.0\r\n"+
+		"Via: SIP/2.0/UDP 127.0.0.1:5060;branch=%s\r\n"+
+		"From: <sip:34020000001320000001@3402000000>;tag=from\r\n"+
+		"To: <sip:34020000002000000001@3402000000>\r\n"+
+		"Call-ID: %s\r\n"+
+		"CSeq: %d %s\r\n"+
+		"Content-Length: 0\r\n\r\n", method, branch, callID, cseq, method)
+}
+
+func response(code int, method, callID, branch string, cseq int) string {
+	return fmt.Sprintf("SIP/2.0 %d X\r\n"+
+		"Via: SIP/2.0/UDP 127.0.0.1:5060;branch=%s\r\n"+
+		"From: <sip:34020000001320000001@3402000000>;tag=from\r\n"+
+		"To: <sip:34020000002000000001@3402000000>;tag=to\r\n"+
+		"Call-ID: %s\r\n"+
+		"CSeq: %d %s\r\n"+
+		"Content-Length: 0\r\n\r\n", code, branch, callID, cseq, method)
+}
+
+func parse(t *testing.T, s string) *sip.Msg {
+	m, err := sip.ParseMsg([]byte(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func recvMsg(tr *Transport, d time.Duration) *sip.Msg {
+	select {
+	case m := <-tr.Recv:
+		return m
+	case <-time.After(d):
+		return nil
+	}
+}
+
+func count(lines []string, prefix string) int {
+	n := 0
+	for _, l := range lines {
+		if strings.HasPrefix(l, prefix) {
+			n++
+		}
+	}
+	return n
+}
+
+// Timer E doubles from T1 up to T2 until the response, the response reaches
+// the user agent once and its retransmission is absorbed.
+func TestClientTxRetransmit(t *testing.T) {
+	defer shortTimers()()
+	tr, p := newPair(t)
+	defer p.close()
+	defer tr.Close()
+
+	tr.Send <- parse(t, request("MESSAGE", "c1", "z9hG4bK-c1", 1))
+	// sent at 0, 10, 30, 70, 110, 150ms...
+	lines := p.collect(time.Millisecond * 170)
+	if n := count(lines, "MESSAGE"); n < 4 || n > 7 {
+		t.Fatalf("%d MESSAGEs in 170ms, want about 6: %v", n, lines)
+	}
+	p.send(response(200, "MESSAGE", "c1", "z9hG4bK-c1", 1))
+	if m := recvMsg(tr, time.Second); m == nil || m.Status != 200 {
+		t.Fatalf("got %v, want the 200", m)
+	}
+	p.send(response(200, "MESSAGE", "c1", "z9hG4bK-c1", 1))
+	if m := recvMsg(tr, time.Millisecond*100); m != nil {
+		t.Fatalf("retransmitted 200 reached the user agent")
+	}
+	if lines := p.collect(time.Millisecond * 100); len(lines) != 0 {
+		t.Fatalf("retransmitted after the final response: %v", lines)
+	}
+}
+
+// A provisional response moves a non-INVITE transaction to Proceeding, it
+// retransmits every T2 from then on.
+func TestClientTxProceeding(t *testing.T) {
+	defer shortTimers()()
+	tr, p := newPair(t)
+	defer p.close()
+	defer tr.Close()
+
+	tr.Send <- parse(t, request("MESSAGE", "c2", "z9hG4bK-c2", 1))
+	p.recv(time.Second)
+	p.send(response(100, "MESSAGE", "c2", "z9hG4bK-c2", 1))
+	if m := recvMsg(tr, time.Second); m == nil || m.Status != 100 {
+		t.Fatalf("got %v, want the 100", m)
+	}
+	lines := p.collect(time.Millisecond * 150)
+	if n := count(lines, "MESSAGE"); n < 2 || n > 4 {
+		t.Fatalf("%d MESSAGEs in 150ms of Proceeding, want about 3 with T2 40ms: %v", n, lines)
+	}
+}
+
+// Timer F reports a 408 to the user agent and stops retransmitting.
+func TestClientTxTimeout(t *testing.T) {
+	defer shortTimers()()
+	tr, p := newPair(t)
+	defer p.close()
+	defer tr.Close()
+
+	start := time.Now()
+	tr.Send <- parse(t, request("MESSAGE", "c3", "z9hG4bK-c3", 1))
+	m := recvMsg(tr, time.Second*3)
+	if m == nil || m.Status != 408 || m.CallID != "c3" {
+		t.Fatalf("got %v, want a 408 for c3", m)
+	}
+	if d := time.Since(start); d < 64*T1 {
+		t.Fatalf("408 after %v, before Timer F", d)
+	}
+	p.collect(time.Millisecond * 20)
+	if lines := p.collect(time.Millisecond * 100); len(lines) != 0 {
+		t.Fatalf("retransmitted after Timer F: %v", lines)
+	}
+}
+
+// Timer A stops at a provisional response, a non-2xx final response is
+// ACKed by the transaction, also when it is retransmitted.
+func TestClientTxInviteNon2xx(t *testing.T) {
+	defer shortTimers()()
+	tr, p := newPair(t)
+	defer p.close()
+	defer tr.Close()
+
+	tr.Send <- parse(t, request("INVITE", "c4", "z9hG4bK-c4", 1))
+	if line := p.recv(time.Second); !strings.HasPrefix(line, "INVITE") {
+		t.Fatalf("got %q, want the INVITE", line)
+	}
+	p.send(response(100, "INVITE", "c4", "z9hG4bK-c4", 1))
+	recvMsg(tr, time.Second)
+	p.collect(time.Millisecond * 15)
+	if lines := p.collect(time.Millisecond * 100); len(lines) != 0 {
+		t.Fatalf("INVITE retransmitted after the 100: %v", lines)
+	}
+	p.send(response(486, "INVITE", "c4", "z9hG4bK-c4", 1))
+	if m := recvMsg(tr, time.Second); m == nil || m.Status != 486 {
+		t.Fatalf("got %v, want the 486", m)
+	}
+	if line := p.recv(time.Second); !strings.HasPrefix(line, "ACK") {
+		t.Fatalf("got %q, want the ACK of the 486", line)
+	}
+	p.send(response(486, "INVITE", "c4", "z9hG4bK-c4", 1))
+	if line := p.recv(time.Second); !strings.HasPrefix(line, "ACK") {
+		t.Fatalf("got %q, want the ACK of the retransmitted 486", line)
+	}
+	if m := recvMsg(tr, time.Millisecond*100); m != nil {
+		t.Fatalf("retransmitted 486 reached the user agent")
+	}
+}
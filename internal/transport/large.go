@@ -0,0 +1,128 @@
+package transport
+
+import (
+	"net"
+
+	"github.com/jart/gosip/sip"
+	"github.com/lzh2nix/gb28181Simulator/internal/config"
+	"github.com/lzh2nix/gb28181Simulator/internal/stats"
+	"github.com/qiniu/x/xlog"
+)
+
+// requests waiting for a tcp connection to a peer, more go out over udp
+const largeQueueSize = 64
+
+// dialLarge opens the tcp connection for large requests, a variable so that
+// tests can hold the dial up.
+var dialLarge = func(addr string) (net.Conn, error) {
+	return net.DialTimeout("tcp", addr, dialTimeout)
+}
+
+// largeConn is the tcp connection to a peer for requests too large for a
+// datagram. Its routine dials it and writes the queued requests, so that the
+// send routine never waits for the dial.
+type largeConn struct {
+	key  string
+	reqs chan *sip.Msg
+	// set once dialed, guarded by Transport.mu
+	conn net.Conn
+	// closed when the connection is lost
+	lost chan struct{}
+}
+
+// sendLarge queues a request that doesn't fit in a datagram for the tcp
+// connection to the same peer. It reports false when the queue is full, so
+// that the caller sends it over udp.
+func (tr *Transport) sendLarge(xlog *xlog.Logger, req *sip.Msg, cfg *config.Config) bool {
+	key := tr.remote.String()
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	lc, ok := tr.largeConns[key]
+	if !ok {
+		lc = &largeConn{key: key, reqs: make(chan *sip.Msg, largeQueueSize), lost: make(chan struct{})}
+		tr.largeConns[key] = lc
+		tr.wg.Add(1)
+		go tr.runLargeConn(xlog, lc, cfg)
+	}
+	// pushed under mu, a connection that is dropped gets no more requests
+	select {
+	case lc.reqs <- req:
+		return true
+	default:
+		xlog.Errorf("tcp queue to %s full, send %s over udp", key, req.Method)
+		return false
+	}
+}
+
+func (tr *Transport) runLargeConn(xlog *xlog.Logger, lc *largeConn, cfg *config.Config) {
+	defer tr.wg.Done()
+	conn, err := dialLarge(lc.key)
+	if err != nil {
+		xlog.Errorf("large requests need tcp, dial %s failed, err = %v", lc.key, err)
+		stats.TransportError("connect")
+		tr.dropLargeConn(lc)
+		tr.sendQueuedOverUDP(xlog, lc)
+		return
+	}
+	xlog.Infof("open tcp connection %s -> %s for large requests", conn.LocalAddr(), lc.key)
+	tr.mu.Lock()
+	lc.conn = conn
+	tr.mu.Unlock()
+	if tr.closed() {
+		conn.Close()
+	}
+	tr.wg.Add(1)
+	go func() {
+		defer tr.wg.Done()
+		err := tr.readStream(xlog, conn, cfg)
+		xlog.Infof("tcp connection %s closed, err = %v", conn.LocalAddr(), err)
+		close(lc.lost)
+	}()
+	defer func() {
+		tr.dropLargeConn(lc)
+		conn.Close()
+		if !tr.closed() {
+			tr.sendQueuedOverUDP(xlog, lc)
+		}
+	}()
+	for {
+		select {
+		case req := <-lc.reqs:
+			req.Via.Transport = "TCP"
+			data := []byte(req.String())
+			tr.startClientTx(xlog, req, data, true)
+			if _, err := conn.Write(data); err != nil {
+				xlog.Errorf("send msg over tcp failed, err = %v", err)
+				stats.TransportError("write")
+				return
+			}
+		case <-lc.lost:
+			return
+		case <-tr.done:
+			return
+		}
+	}
+}
+
+// sendQueuedOverUDP sends what was queued for a connection that couldn't be
+// dialed or was lost as datagrams, fragmented or not.
+func (tr *Transport) sendQueuedOverUDP(xlog *xlog.Logger, lc *largeConn) {
+	for {
+		select {
+		case req := <-lc.reqs:
+			data := []byte(req.String())
+			tr.startClientTx(xlog, req, data, false)
+			tr.write(xlog, data, nil)
+		default:
+			return
+		}
+	}
+}
+
+func (tr *Transport) dropLargeConn(lc *largeConn) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if tr.largeConns[lc.key] == lc {
+		delete(tr.largeConns, lc.key)
+	}
+}
@@ -0,0 +1,82 @@
+package transport
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func largeRequest(callID string) string {
+	body := strings.Repeat("x", sipMTUPacketSize)
+	msg := request("MESSAGE", callID, "z9hG4bK-"+callID, 1)
+	return strings.Replace(msg, "Content-Length: 0\r\n\r\n",
+		"Content-Type: Application/MANSCDP+xml\r\nContent-Length: "+strconv.Itoa(len(body))+"\r\n\r\n"+body, 1)
+}
+
+// A request too large for a datagram goes over tcp, the ones after it don't
+// wait for the connection.
+func TestSendLarge(t *testing.T) {
+	tr, p := newPair(t)
+	defer p.close()
+	defer tr.Close()
+	ln, err := net.Listen("tcp", p.conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	overTCP := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		overTCP <- strings.TrimSpace(line)
+	}()
+
+	// the dial hangs until the small request went out
+	dialed := make(chan struct{})
+	defer func(dial func(string) (net.Conn, error)) { dialLarge = dial }(dialLarge)
+	dialLarge = func(addr string) (net.Conn, error) {
+		<-dialed
+		return net.Dial("tcp", addr)
+	}
+
+	tr.Send <- parse(t, largeRequest("large"))
+	tr.Send <- parse(t, request("MESSAGE", "small", "z9hG4bK-small", 1))
+	line := p.recv(time.Second)
+	close(dialed)
+	if !strings.HasPrefix(line, "MESSAGE") {
+		t.Fatalf("got %q over udp, want the small MESSAGE", line)
+	}
+	select {
+	case line := <-overTCP:
+		if !strings.HasPrefix(line, "MESSAGE") {
+			t.Errorf("got %q over tcp, want the large MESSAGE", line)
+		}
+	case <-time.After(time.Second * 2):
+		t.Fatal("nothing received over tcp")
+	}
+}
+
+// Without a tcp listener the large request still goes out, over udp.
+func TestSendLargeNoTCP(t *testing.T) {
+	tr, p := newPair(t)
+	defer p.close()
+	defer tr.Close()
+	// make sure nothing listens on the port
+	ln, err := net.Listen("tcp", p.conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.Close()
+
+	tr.Send <- parse(t, largeRequest("large"))
+	if line := p.recv(dialTimeout + time.Second); !strings.HasPrefix(line, "MESSAGE") {
+		t.Fatalf("got %q, want the large MESSAGE over udp", line)
+	}
+}
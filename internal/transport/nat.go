@@ -0,0 +1,80 @@
+package transport
+
+import (
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/jart/gosip/sip"
+)
+
+// ContactAddr returns the host and port to advertise in Via and Contact
+// headers: the configured advertisedIP, else the address the registrar saw
+// us from (RFC 3581), else the local address.
+func (tr *Transport) ContactAddr() (string, int) {
+	host, port := tr.LocalAddr()
+	s := tr.socket()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.advertisedIP != "" {
+		return s.advertisedIP, port
+	}
+	if s.publicIP != "" {
+		return s.publicIP, s.publicPort
+	}
+	return host, port
+}
+
+// LearnPublicAddr records the received and rport parameters the server put
+// in our Via, and reports whether the request went out with another address
+// than the one the server saw, in which case the device has to register
+// again. On a Pool socket the address may have been learned by another
+// device already.
+func (tr *Transport) LearnPublicAddr(via *sip.Via) bool {
+	if via == nil {
+		return false
+	}
+	sent := int(via.Port)
+	if sent == 0 {
+		sent = 5060
+	}
+	// without the parameters the server saw what we sent
+	ip, port := via.Host, sent
+	if p := via.Param.Get("received"); p != nil && p.Value != "" {
+		ip = p.Value
+	}
+	if p := via.Param.Get("rport"); p != nil && p.Value != "" {
+		if n, err := strconv.Atoi(p.Value); err == nil {
+			port = n
+		}
+	}
+	s := tr.socket()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.publicIP, s.publicPort = ip, port
+	if s.advertisedIP != "" {
+		return false
+	}
+	return !sameIP(ip, via.Host) || port != sent
+}
+
+// sameIP compares two addresses, ipv6 ones may be spelled differently.
+func sameIP(a, b string) bool {
+	if ipa, ipb := net.ParseIP(a), net.ParseIP(b); ipa != nil && ipb != nil {
+		return ipa.Equal(ipb)
+	}
+	return a == b
+}
+
+// ViaHost brackets ipv6 literals, sip.Via writes its host verbatim.
+func ViaHost(host string) string {
+	if strings.Contains(host, ":") && !strings.HasPrefix(host, "[") {
+		return "[" + host + "]"
+	}
+	return host
+}
+
+// OutboundIP returns the local ip the kernel picks to reach ip.
+func OutboundIP(ip string) (net.IP, error) {
+	return outboundIP(&net.UDPAddr{IP: net.ParseIP(ip), Port: 9})
+}
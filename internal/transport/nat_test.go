@@ -0,0 +1,99 @@
+package transport
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/lzh2nix/gb28181Simulator/internal/config"
+	"github.com/qiniu/x/xlog"
+)
+
+func registerResponse(via string) string {
+	return fmt.Sprintf("SIP/2.0 200 OK\r\n"+
+		"Via: %s\r\n"+
+		"From: <sip:34020000001320000001@3402000000>;tag=from\r\n"+
+		"To: <sip:34020000001320000001@3402000000>;tag=to\r\n"+
+		"Call-ID: nat\r\n"+
+		"CSeq: 1 REGISTER\r\n"+
+		"Content-Length: 0\r\n\r\n", via)
+}
+
+func TestLearnPublicAddr(t *testing.T) {
+	tests := []struct {
+		name       string
+		advertised string
+		via        string
+		reregister bool
+		host       string
+		port       int
+	}{
+		{"unchanged", "", "SIP/2.0/UDP 192.168.1.10:5060;rport=5060;received=192.168.1.10;branch=z9hG4bK-1",
+			false, "192.168.1.10", 5060},
+		{"no parameters", "", "SIP/2.0/UDP 192.168.1.10:5060;branch=z9hG4bK-1",
+			false, "192.168.1.10", 5060},
+		{"received changed", "", "SIP/2.0/UDP 192.168.1.10:5060;rport=5060;received=203.0.113.7;branch=z9hG4bK-1",
+			true, "203.0.113.7", 5060},
+		{"rport changed", "", "SIP/2.0/UDP 192.168.1.10:5060;rport=40000;received=192.168.1.10;branch=z9hG4bK-1",
+			true, "192.168.1.10", 40000},
+		{"default port", "", "SIP/2.0/UDP 192.168.1.10;rport=5060;branch=z9hG4bK-1",
+			false, "192.168.1.10", 5060},
+		{"ipv6 unchanged", "", "SIP/2.0/UDP [2001:db8::10]:5060;rport=5060;received=2001:db8::10;branch=z9hG4bK-1",
+			false, "2001:db8::10", 5060},
+		{"ipv6 other spelling", "", "SIP/2.0/UDP [2001:db8::10]:5060;rport=5060;received=2001:DB8:0:0::10;branch=z9hG4bK-1",
+			false, "2001:DB8:0:0::10", 5060},
+		{"ipv6 changed", "", "SIP/2.0/UDP [2001:db8::10]:5060;rport=5062;received=2001:db8::99;branch=z9hG4bK-1",
+			true, "2001:db8::99", 5062},
+		{"advertised", "198.51.100.1", "SIP/2.0/UDP 192.168.1.10:5060;rport=40000;received=203.0.113.7;branch=z9hG4bK-1",
+			false, "198.51.100.1", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			tr, err := StartSip(xlog.New("nat-test"), conn.LocalAddr().String(), "udp", &config.Config{AdvertisedIP: tt.advertised})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer tr.Close()
+			m := parse(t, registerResponse(tt.via))
+			if got := tr.LearnPublicAddr(m.Via); got != tt.reregister {
+				t.Errorf("register again = %v, want %v", got, tt.reregister)
+			}
+			host, port := tr.ContactAddr()
+			if tt.port == 0 {
+				// the local port stays with an advertised ip
+				_, tt.port = tr.LocalAddr()
+			}
+			if host != tt.host || port != tt.port {
+				t.Errorf("contact %s:%d, want %s:%d", host, port, tt.host, tt.port)
+			}
+		})
+	}
+}
+
+func TestContactAddrBeforeRegister(t *testing.T) {
+	tr, p := newPair(t)
+	defer p.close()
+	defer tr.Close()
+	host, port := tr.ContactAddr()
+	if lhost, lport := tr.LocalAddr(); host != lhost || port != lport {
+		t.Errorf("contact %s:%d, want the local address %s:%d", host, port, lhost, lport)
+	}
+}
+
+func TestViaHost(t *testing.T) {
+	for in, want := range map[string]string{
+		"192.168.1.10":   "192.168.1.10",
+		"2001:db8::1":    "[2001:db8::1]",
+		"[2001:db8::1]":  "[2001:db8::1]",
+		"sip.example.cn": "sip.example.cn",
+	} {
+		if got := ViaHost(in); got != want {
+			t.Errorf("ViaHost(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
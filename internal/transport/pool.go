@@ -0,0 +1,145 @@
+package transport
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/jart/gosip/sip"
+	"github.com/lzh2nix/gb28181Simulator/internal/config"
+	"github.com/qiniu/x/xlog"
+)
+
+// messages queued per endpoint before the socket starts dropping, so that a
+// busy device can't stall the others sharing its socket
+const endpointQueueSize = 64
+
+var ErrEmptyPool = errors.New("pool needs at least one socket")
+
+// Pool shares a few sockets between many device identities. Each device gets
+// an endpoint Transport whose Send is the one of its socket and whose Recv
+// only sees the messages addressed to the device: requests by dialog, then by
+// Request-URI or To user, responses by From user.
+//
+// The sockets bound the file descriptors and the goroutines reading and
+// writing them. The devices keep their own goroutines: the message loop and
+// the registration timers of each device, plus the media of its sessions.
+type Pool struct {
+	socks []*Transport
+
+	mu   sync.Mutex
+	next int
+	// device and channel ids
+	users map[string]*Transport
+	// INVITE dialogs by Call-ID, the ACK and BYE of a channel invite may
+	// carry another Request-URI. An entry lives until either side's BYE or
+	// the final non-2xx response to the INVITE.
+	dialogs map[string]*Transport
+}
+
+// NewPool starts size sockets, the k-th one on cfg.LocalSipPort+k unless the
+// port is 0.
+func NewPool(xlog *xlog.Logger, remoteAddr string, transport string, cfg *config.Config, size int) (*Pool, error) {
+	if size <= 0 {
+		return nil, ErrEmptyPool
+	}
+	p := &Pool{
+		users:   make(map[string]*Transport),
+		dialogs: make(map[string]*Transport),
+	}
+	for k := 0; k < size; k++ {
+		c := *cfg
+		if cfg.LocalSipPort != 0 {
+			c.LocalSipPort = cfg.LocalSipPort + k
+		}
+		sock, err := startSip(xlog, remoteAddr, transport, &c, p)
+		if err != nil {
+			return nil, err
+		}
+		p.socks = append(p.socks, sock)
+	}
+	return p, nil
+}
+
+// Endpoint returns the transport of a device, ids are its device id and the
+// ids of its channels. Devices are spread over the sockets round-robin.
+func (p *Pool) Endpoint(ids ...string) *Transport {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	sock := p.socks[p.next%len(p.socks)]
+	p.next++
+	ep := &Transport{
+		Recv: make(chan *sip.Msg, endpointQueueSize),
+		Send: sock.Send,
+		sock: sock,
+	}
+	for _, id := range ids {
+		p.users[id] = ep
+	}
+	return ep
+}
+
+// Close closes the sockets, call it once the devices have stopped.
+func (p *Pool) Close() {
+	for _, sock := range p.socks {
+		sock.Close()
+	}
+}
+
+func (p *Pool) route(xlog *xlog.Logger, m *sip.Msg) {
+	ep := p.lookup(m)
+	if ep == nil {
+		xlog.Infof("no device for %s, drop, callId:%s", describe(m), m.CallID)
+		return
+	}
+	select {
+	case ep.Recv <- m:
+	default:
+		xlog.Errorf("device queue full, drop %s, callId:%s", describe(m), m.CallID)
+	}
+}
+
+// sent forgets the dialog of a rejected INVITE or one the device hangs up.
+func (p *Pool) sent(m *sip.Msg) {
+	rejected := m.IsResponse() && m.CSeqMethod == sip.MethodInvite && m.Status >= 300
+	if !rejected && (m.IsResponse() || m.Method != sip.MethodBye) {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.dialogs, m.CallID)
+}
+
+func (p *Pool) lookup(m *sip.Msg) *Transport {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if ep, ok := p.dialogs[m.CallID]; ok {
+		if !m.IsResponse() && m.Method == sip.MethodBye {
+			delete(p.dialogs, m.CallID)
+		}
+		return ep
+	}
+	if m.IsResponse() {
+		if m.From == nil || m.From.Uri == nil {
+			return nil
+		}
+		return p.users[m.From.Uri.User]
+	}
+	var ep *Transport
+	if m.Request != nil {
+		ep = p.users[m.Request.User]
+	}
+	if ep == nil && m.To != nil && m.To.Uri != nil {
+		ep = p.users[m.To.Uri.User]
+	}
+	if ep != nil && m.Method == sip.MethodInvite {
+		p.dialogs[m.CallID] = ep
+	}
+	return ep
+}
+
+func describe(m *sip.Msg) string {
+	if m.IsResponse() {
+		return m.CSeqMethod + " response"
+	}
+	return m.Method
+}
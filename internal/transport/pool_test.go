@@ -0,0 +1,80 @@
+package transport
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lzh2nix/gb28181Simulator/internal/config"
+	"github.com/qiniu/x/xlog"
+)
+
+func (p *Pool) dialogCount() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.dialogs)
+}
+
+// A dialog is routed until either side's BYE or the rejection of its INVITE,
+// nothing is left of it afterwards.
+func TestPoolDialogs(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	pool, err := NewPool(xlog.New("pool-test"), conn.LocalAddr().String(), "udp", &config.Config{}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	// the device's channel is the To user of the INVITEs below
+	ep := pool.Endpoint("34020000001320000001", "34020000002000000001")
+	_, port := ep.LocalAddr()
+	p := &peer{t: t, conn: conn, to: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}}
+
+	tests := []struct {
+		name string
+		// what ends the dialog once the INVITE reached the device
+		end func(callID, branch string)
+	}{
+		{"rejected", func(callID, branch string) {
+			ep.Send <- parse(t, response(486, "INVITE", callID, branch, 1))
+		}},
+		{"device bye", func(callID, branch string) {
+			ep.Send <- parse(t, response(200, "INVITE", callID, branch, 1))
+			p.send(request("ACK", callID, branch+"-ack", 1))
+			recvMsg(ep, time.Second)
+			ep.Send <- parse(t, strings.Replace(request("BYE", callID, branch+"-bye", 2), "UDP 127.0.0.1:5060", "UDP 127.0.0.1:5070", 1))
+		}},
+		{"platform bye", func(callID, branch string) {
+			ep.Send <- parse(t, response(200, "INVITE", callID, branch, 1))
+			p.send(request("ACK", callID, branch+"-ack", 1))
+			recvMsg(ep, time.Second)
+			p.send(request("BYE", callID, branch+"-bye", 2))
+			recvMsg(ep, time.Second)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			callID := "pool-" + strings.Replace(tt.name, " ", "-", -1)
+			branch := "z9hG4bK-" + callID
+			p.send(request("INVITE", callID, branch, 1))
+			if m := recvMsg(ep, time.Second); m == nil || m.Method != "INVITE" {
+				t.Fatalf("got %v, want the INVITE", m)
+			}
+			if n := pool.dialogCount(); n != 1 {
+				t.Fatalf("%d dialogs after the INVITE, want 1", n)
+			}
+			tt.end(callID, branch)
+			deadline := time.Now().Add(time.Second)
+			for pool.dialogCount() != 0 {
+				if time.Now().After(deadline) {
+					t.Fatalf("dialog left after %s", tt.name)
+				}
+				time.Sleep(time.Millisecond * 5)
+			}
+		})
+	}
+}
@@ -0,0 +1,168 @@
+package transport
+
+import (
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/jart/gosip/sip"
+	"github.com/qiniu/x/xlog"
+)
+
+// serverTx is a server transaction (RFC 3261 §17.2). It absorbs retransmitted
+// requests and replays the last response to them. Final responses to an
+// INVITE are retransmitted over UDP (Timer G) until the ACK arrives or
+// Timer H fires.
+type serverTx struct {
+	key      string
+	ackKey   string
+	req      *sip.Msg
+	resp     []byte
+	status   int
+	state    int
+	interval time.Duration
+	retrans  *time.Timer // Timer G
+	timeout  *time.Timer // Timer H, I or J
+}
+
+func ackKey(callID string, cseq int) string {
+	return callID + " " + strconv.Itoa(cseq)
+}
+
+// handleServerRequest reports whether an incoming request was absorbed by a
+// server transaction and must not reach the user agent.
+func (tr *Transport) handleServerRequest(xlog *xlog.Logger, req *sip.Msg) bool {
+	if req.Method == sip.MethodAck {
+		return tr.handleAck(xlog, req)
+	}
+	branch := req.Via.Param.Get("branch")
+	if branch == nil {
+		return false
+	}
+	key := txKey(branch.Value, req.Method)
+	tr.txMu.Lock()
+	if tx, ok := tr.serverTxs[key]; ok {
+		var replay []byte
+		if tx.resp != nil && tx.state != txTerminated {
+			xlog.Debugf("retransmitted %s, replay %d, callId:%s", req.Method, tx.status, req.CallID)
+			replay = tx.resp
+		}
+		tr.txMu.Unlock()
+		if replay != nil {
+			// outside txMu, a blocked write must not hold up the timers
+			tr.write(xlog, replay, req.SourceAddr)
+		}
+		return true
+	}
+	tx := &serverTx{key: key, req: req, state: txProceeding}
+	// requests the user agent never answers are forgotten after 64*T1
+	tx.timeout = time.AfterFunc(64*T1, func() { tr.serverTxTimeout(xlog, tx) })
+	tr.serverTxs[key] = tx
+	if req.Method == sip.MethodInvite {
+		tx.ackKey = ackKey(req.CallID, req.CSeq)
+		tr.inviteTxs[tx.ackKey] = tx
+	}
+	tr.txMu.Unlock()
+	return false
+}
+
+// handleAck matches an ACK to its INVITE server transaction. The ACK of a
+// non-2xx response is consumed by the transaction, the first ACK of a 2xx is
+// passed on to the dialog and retransmitted ones are dropped.
+func (tr *Transport) handleAck(xlog *xlog.Logger, ack *sip.Msg) bool {
+	tr.txMu.Lock()
+	defer tr.txMu.Unlock()
+	tx, ok := tr.inviteTxs[ackKey(ack.CallID, ack.CSeq)]
+	if !ok {
+		return false
+	}
+	if tx.state != txCompleted {
+		return tx.state == txConfirmed
+	}
+	if tx.retrans != nil {
+		tx.retrans.Stop()
+	}
+	tx.state = txConfirmed
+	wait := T4 // Timer I
+	if tr.reliable() {
+		wait = 0
+	}
+	tx.timeout.Reset(wait)
+	return tx.status >= 300
+}
+
+// handleServerResponse records an outgoing response in its server
+// transaction so that it can be replayed, and starts the transaction timers
+// once the response is final. It returns where the request came from.
+func (tr *Transport) handleServerResponse(xlog *xlog.Logger, resp *sip.Msg, data []byte) *net.UDPAddr {
+	branch := resp.Via.Param.Get("branch")
+	if branch == nil {
+		return nil
+	}
+	tr.txMu.Lock()
+	defer tr.txMu.Unlock()
+	tx, ok := tr.serverTxs[txKey(branch.Value, resp.CSeqMethod)]
+	if !ok {
+		return nil
+	}
+	if tx.state != txProceeding {
+		return tx.req.SourceAddr
+	}
+	tx.resp = data
+	tx.status = resp.Status
+	if resp.Status < 200 {
+		return tx.req.SourceAddr
+	}
+	tx.state = txCompleted
+	if tx.req.Method != sip.MethodInvite {
+		wait := 64 * T1 // Timer J
+		if tr.reliable() {
+			wait = 0
+		}
+		tx.timeout.Reset(wait)
+		return tx.req.SourceAddr
+	}
+	if !tr.reliable() {
+		tx.interval = T1
+		tx.retrans = time.AfterFunc(tx.interval, func() { tr.retransmitResponse(xlog, tx) })
+	}
+	tx.timeout.Reset(64 * T1) // Timer H
+	return tx.req.SourceAddr
+}
+
+func (tr *Transport) retransmitResponse(xlog *xlog.Logger, tx *serverTx) {
+	tr.txMu.Lock()
+	if tx.state != txCompleted {
+		tr.txMu.Unlock()
+		return
+	}
+	if tx.interval *= 2; tx.interval > T2 {
+		tx.interval = T2
+	}
+	tx.retrans.Reset(tx.interval)
+	tr.txMu.Unlock()
+	xlog.Debugf("retransmit %d(%s), callId:%s", tx.status, tx.req.Method, tx.req.CallID)
+	tr.write(xlog, tx.resp, tx.req.SourceAddr)
+}
+
+// serverTxTimeout ends the transaction. When Timer H fires on a 2xx the
+// dialog is told with a 408 so that it can hang up (RFC 3261 §13.3.1.4).
+func (tr *Transport) serverTxTimeout(xlog *xlog.Logger, tx *serverTx) {
+	tr.txMu.Lock()
+	noAck := tx.state == txCompleted && tx.req.Method == sip.MethodInvite
+	if noAck {
+		xlog.Errorf("no ACK for %d(INVITE), callId:%s", tx.status, tx.req.CallID)
+	}
+	tx.state = txTerminated
+	if tx.retrans != nil {
+		tx.retrans.Stop()
+	}
+	delete(tr.serverTxs, tx.key)
+	if tx.ackKey != "" {
+		delete(tr.inviteTxs, tx.ackKey)
+	}
+	tr.txMu.Unlock()
+	if noAck && tx.status < 300 {
+		tr.dispatch(xlog, timeoutResponse(tx.req))
+	}
+}
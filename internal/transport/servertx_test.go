@@ -0,0 +1,110 @@
+package transport
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// A retransmitted request is absorbed, and replayed the response once the
+// user agent answered.
+func TestServerTxAbsorb(t *testing.T) {
+	defer shortTimers()()
+	tr, p := newPair(t)
+	defer p.close()
+	defer tr.Close()
+
+	req := request("MESSAGE", "s1", "z9hG4bK-s1", 1)
+	p.send(req)
+	if m := recvMsg(tr, time.Second); m == nil || m.Method != "MESSAGE" {
+		t.Fatalf("got %v, want the MESSAGE", m)
+	}
+	p.send(req)
+	if m := recvMsg(tr, time.Millisecond*100); m != nil {
+		t.Fatal("retransmitted request reached the user agent")
+	}
+	tr.Send <- parse(t, response(200, "MESSAGE", "s1", "z9hG4bK-s1", 1))
+	if line := p.recv(time.Second); !strings.HasPrefix(line, "SIP/2.0 200") {
+		t.Fatalf("got %q, want the 200", line)
+	}
+	p.send(req)
+	if line := p.recv(time.Second); !strings.HasPrefix(line, "SIP/2.0 200") {
+		t.Fatalf("got %q, want the replayed 200", line)
+	}
+	if m := recvMsg(tr, time.Millisecond*100); m != nil {
+		t.Fatal("retransmitted request reached the user agent")
+	}
+}
+
+// Timer G retransmits the 200 of an INVITE until the ACK, which reaches the
+// user agent once.
+func TestServerTxInviteAck(t *testing.T) {
+	defer shortTimers()()
+	tr, p := newPair(t)
+	defer p.close()
+	defer tr.Close()
+
+	p.send(request("INVITE", "s2", "z9hG4bK-s2", 1))
+	if m := recvMsg(tr, time.Second); m == nil || m.Method != "INVITE" {
+		t.Fatalf("got %v, want the INVITE", m)
+	}
+	tr.Send <- parse(t, response(200, "INVITE", "s2", "z9hG4bK-s2", 1))
+	lines := p.collect(time.Millisecond * 80)
+	if n := count(lines, "SIP/2.0 200"); n < 3 {
+		t.Fatalf("%d 200s in 80ms, want retransmissions: %v", n, lines)
+	}
+	ack := request("ACK", "s2", "z9hG4bK-ack", 1)
+	p.send(ack)
+	if m := recvMsg(tr, time.Second); m == nil || m.Method != "ACK" {
+		t.Fatalf("got %v, want the ACK", m)
+	}
+	p.send(ack)
+	if m := recvMsg(tr, time.Millisecond*100); m != nil {
+		t.Fatal("retransmitted ACK reached the user agent")
+	}
+	p.collect(time.Millisecond * 10)
+	if lines := p.collect(time.Millisecond * 100); len(lines) != 0 {
+		t.Fatalf("200 retransmitted after the ACK: %v", lines)
+	}
+}
+
+// The ACK of a non-2xx response belongs to the transaction.
+func TestServerTxInviteNon2xx(t *testing.T) {
+	defer shortTimers()()
+	tr, p := newPair(t)
+	defer p.close()
+	defer tr.Close()
+
+	p.send(request("INVITE", "s3", "z9hG4bK-s3", 1))
+	recvMsg(tr, time.Second)
+	tr.Send <- parse(t, response(486, "INVITE", "s3", "z9hG4bK-s3", 1))
+	if line := p.recv(time.Second); !strings.HasPrefix(line, "SIP/2.0 486") {
+		t.Fatalf("got %q, want the 486", line)
+	}
+	p.send(request("ACK", "s3", "z9hG4bK-s3", 1))
+	if m := recvMsg(tr, time.Millisecond*100); m != nil {
+		t.Fatal("ACK of the 486 reached the user agent")
+	}
+}
+
+// Timer H ends the retransmission of a 200 that is never ACKed and tells the
+// dialog.
+func TestServerTxNoAck(t *testing.T) {
+	defer shortTimers()()
+	tr, p := newPair(t)
+	defer p.close()
+	defer tr.Close()
+
+	p.send(request("INVITE", "s4", "z9hG4bK-s4", 1))
+	recvMsg(tr, time.Second)
+	tr.Send <- parse(t, response(200, "INVITE", "s4", "z9hG4bK-s4", 1))
+	p.collect(64*T1 + time.Millisecond*20)
+	if lines := p.collect(time.Millisecond * 100); len(lines) != 0 {
+		t.Fatalf("200 retransmitted after Timer H: %v", lines)
+	}
+	// the dialog learns about it to hang up
+	m := recvMsg(tr, time.Second)
+	if m == nil || m.Status != 408 || m.CSeqMethod != "INVITE" || m.CallID != "s4" {
+		t.Fatalf("got %v, want the 408 of Timer H", m)
+	}
+}
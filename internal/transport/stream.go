@@ -0,0 +1,171 @@
+package transport
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/jart/gosip/sip"
+	"github.com/lzh2nix/gb28181Simulator/internal/config"
+	"github.com/lzh2nix/gb28181Simulator/internal/stats"
+	"github.com/qiniu/x/xlog"
+)
+
+const (
+	dialTimeout = time.Second * 5
+	// upper bound of a single sip message read from a stream connection
+	sipMaxStreamMsgSize = 64 * 1024
+	minReconnectDelay   = time.Second
+	maxReconnectDelay   = time.Second * 30
+)
+
+var ErrMsgTooLarge = errors.New("sip message too large")
+
+// dialTCP binds the connection to localPort so that the platform sees the
+// configured port, and falls back to an ephemeral one while the previous
+// connection still holds it.
+func dialTCP(xlog *xlog.Logger, addr string, localPort int) (net.Conn, error) {
+	d := &net.Dialer{Timeout: dialTimeout}
+	if localPort != 0 {
+		d.LocalAddr = &net.TCPAddr{Port: localPort}
+	}
+	conn, err := d.Dial("tcp", addr)
+	if err != nil && d.LocalAddr != nil && errors.Is(err, syscall.EADDRINUSE) {
+		xlog.Infof("local port %d in use, dial from an ephemeral port", localPort)
+		d.LocalAddr = nil
+		conn, err = d.Dial("tcp", addr)
+	}
+	return conn, err
+}
+
+// startStream dials the server once, so that a wrong address is reported at
+// startup, then keeps the connection alive and redials whenever it drops.
+func startStream(xlog *xlog.Logger, proto string, cfg *config.Config, dial func() (net.Conn, error), r router) (*Transport, error) {
+	conn, err := dial()
+	if err != nil {
+		xlog.Errorf("dial %s failed, err = %v", proto, err)
+		return nil, err
+	}
+	tr := newTransport(proto, cfg, r)
+	tr.setConn(conn)
+	go tr.send(xlog, cfg)
+	tr.wg.Add(1)
+	go tr.recvStream(xlog, conn, dial, cfg)
+	return tr, nil
+}
+
+func (tr *Transport) recvStream(xlog *xlog.Logger, conn net.Conn, dial func() (net.Conn, error), cfg *config.Config) {
+	defer tr.wg.Done()
+	delay := minReconnectDelay
+	for {
+		if conn != nil {
+			err := tr.readStream(xlog, conn, cfg)
+			if tr.closed() {
+				return
+			}
+			xlog.Errorf("%s connection %s lost, err = %v", tr.proto, conn.LocalAddr(), err)
+			stats.TransportError("disconnect")
+			tr.setConn(nil)
+			conn.Close()
+			conn = nil
+		}
+		select {
+		case <-time.After(delay):
+		case <-tr.done:
+			return
+		}
+		c, err := dial()
+		if err != nil {
+			xlog.Errorf("reconnect %s failed, err = %v", tr.proto, err)
+			stats.TransportError("connect")
+			if delay *= 2; delay > maxReconnectDelay {
+				delay = maxReconnectDelay
+			}
+			continue
+		}
+		if tr.closed() {
+			c.Close()
+			return
+		}
+		xlog.Infof("%s reconnected, local addr %s", tr.proto, c.LocalAddr())
+		delay = minReconnectDelay
+		conn = c
+		tr.setConn(conn)
+		tr.notifyReconnect()
+	}
+}
+
+func (tr *Transport) readStream(xlog *xlog.Logger, conn net.Conn, cfg *config.Config) error {
+	r := bufio.NewReader(conn)
+	for {
+		data, err := readStreamMsg(r)
+		if err != nil {
+			return err
+		}
+		msg, err := sip.ParseMsg(data)
+		if err != nil {
+			xlog.Errorf("parse msg failed, err =%v", err)
+			stats.TransportError("parse")
+			continue
+		}
+		tr.deliver(xlog, msg, cfg)
+	}
+}
+
+// readStreamMsg reads one message framed by its Content-Length header,
+// skipping the CRLF keepalives allowed between messages (RFC 5626 §3.5.1).
+func readStreamMsg(r *bufio.Reader) ([]byte, error) {
+	var buf bytes.Buffer
+	clen := 0
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		blank := strings.TrimRight(line, "\r\n") == ""
+		if blank && buf.Len() == 0 {
+			continue
+		}
+		buf.WriteString(line)
+		if buf.Len() > sipMaxStreamMsgSize {
+			return nil, ErrMsgTooLarge
+		}
+		if blank {
+			break
+		}
+		if n, ok := contentLength(line); ok {
+			clen = n
+		}
+	}
+	if clen < 0 || buf.Len()+clen > sipMaxStreamMsgSize {
+		return nil, ErrMsgTooLarge
+	}
+	body := make([]byte, clen)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	buf.Write(body)
+	return buf.Bytes(), nil
+}
+
+func contentLength(line string) (int, bool) {
+	i := strings.IndexByte(line, ':')
+	if i < 0 {
+		return 0, false
+	}
+	name := strings.TrimSpace(line[:i])
+	if !strings.EqualFold(name, "Content-Length") && !strings.EqualFold(name, "l") {
+		return 0, false
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[i+1:]))
+	if err != nil {
+		return 0, false
+	}
+	return n, true
+}
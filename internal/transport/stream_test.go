@@ -0,0 +1,88 @@
+package transport
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"testing"
+)
+
+const (
+	optionsMsg = "OPTIONS sip:a@b SIP/2.0\r\nCall-ID: 1\r\nContent-Length: 0\r\n\r\n"
+	messageMsg = "MESSAGE sip:a@b SIP/2.0\r\nCall-ID: 2\r\nContent-Length: 5\r\n\r\nhello"
+)
+
+func TestReadStreamMsg(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  []string
+		// error after the messages in want
+		err error
+	}{
+		{"no body", optionsMsg, []string{optionsMsg}, io.EOF},
+		{"body", messageMsg, []string{messageMsg}, io.EOF},
+		{"pipelined", messageMsg + optionsMsg, []string{messageMsg, optionsMsg}, io.EOF},
+		{"keepalives", "\r\n\r\n" + optionsMsg + "\r\n" + messageMsg, []string{optionsMsg, messageMsg}, io.EOF},
+		{
+			"compact header",
+			"MESSAGE sip:a@b SIP/2.0\r\nl: 3\r\n\r\nabc",
+			[]string{"MESSAGE sip:a@b SIP/2.0\r\nl: 3\r\n\r\nabc"},
+			io.EOF,
+		},
+		{
+			"no content length",
+			"ACK sip:a@b SIP/2.0\r\nCall-ID: 3\r\n\r\n",
+			[]string{"ACK sip:a@b SIP/2.0\r\nCall-ID: 3\r\n\r\n"},
+			io.EOF,
+		},
+		{"truncated body", "MESSAGE sip:a@b SIP/2.0\r\nContent-Length: 10\r\n\r\nabc", nil, io.ErrUnexpectedEOF},
+		{"truncated header", "MESSAGE sip:a@b SIP/2.0\r\nContent-Le", nil, io.EOF},
+		{"negative length", "MESSAGE sip:a@b SIP/2.0\r\nContent-Length: -1\r\n\r\n", nil, ErrMsgTooLarge},
+		{"body too large", "MESSAGE sip:a@b SIP/2.0\r\nContent-Length: 70000\r\n\r\n", nil, ErrMsgTooLarge},
+		{
+			"header too large",
+			"MESSAGE sip:a@b SIP/2.0\r\nSubject: " + strings.Repeat("x", sipMaxStreamMsgSize) + "\r\n\r\n",
+			nil,
+			ErrMsgTooLarge,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bufio.NewReader(strings.NewReader(tt.input))
+			for i, want := range tt.want {
+				got, err := readStreamMsg(r)
+				if err != nil {
+					t.Fatalf("message %d: %v", i, err)
+				}
+				if string(got) != want {
+					t.Fatalf("message %d = %q, want %q", i, got, want)
+				}
+			}
+			if _, err := readStreamMsg(r); err != tt.err {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestContentLength(t *testing.T) {
+	tests := []struct {
+		line string
+		n    int
+		ok   bool
+	}{
+		{"Content-Length: 12\r\n", 12, true},
+		{"content-length:7\r\n", 7, true},
+		{"l: 3\r\n", 3, true},
+		{"Content-Type: application/sdp\r\n", 0, false},
+		{"Content-Length: x\r\n", 0, false},
+		{"no colon\r\n", 0, false},
+	}
+	for _, tt := range tests {
+		n, ok := contentLength(tt.line)
+		if n != tt.n || ok != tt.ok {
+			t.Errorf("contentLength(%q) = %d, %v, want %d, %v", tt.line, n, ok, tt.n, tt.ok)
+		}
+	}
+}
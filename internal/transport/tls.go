@@ -0,0 +1,79 @@
+package transport
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net"
+	"time"
+
+	"github.com/lzh2nix/gb28181Simulator/internal/config"
+)
+
+var ErrBadCABundle = errors.New("no certificate found in ca bundle")
+
+func newTLSConfig(cfg *config.Config) (*tls.Config, error) {
+	tc := &tls.Config{ServerName: cfg.TLSServerName}
+	if cfg.TLSCAFile != "" {
+		pem, err := ioutil.ReadFile(cfg.TLSCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, ErrBadCABundle
+		}
+		tc.RootCAs = pool
+	}
+	if cfg.TLSCertFile != "" || cfg.TLSKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+	if cfg.TLSServerName == "" {
+		// access servers are mostly addressed by ip, so without a configured
+		// server name only the certificate chain is checked
+		tc.InsecureSkipVerify = true
+		tc.VerifyPeerCertificate = verifyChain(tc.RootCAs)
+	}
+	return tc, nil
+}
+
+func handshakeTLS(conn net.Conn, tc *tls.Config) (net.Conn, error) {
+	c := tls.Client(conn, tc)
+	c.SetDeadline(time.Now().Add(dialTimeout))
+	if err := c.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	c.SetDeadline(time.Time{})
+	return c, nil
+}
+
+func verifyChain(roots *x509.CertPool) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		certs := make([]*x509.Certificate, len(rawCerts))
+		for i, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return err
+			}
+			certs[i] = cert
+		}
+		if len(certs) == 0 {
+			return errors.New("server sent no certificate")
+		}
+		opts := x509.VerifyOptions{
+			Roots:         roots,
+			Intermediates: x509.NewCertPool(),
+		}
+		for _, cert := range certs[1:] {
+			opts.Intermediates.AddCert(cert)
+		}
+		_, err := certs[0].Verify(opts)
+		return err
+	}
+}
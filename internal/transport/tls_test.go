@@ -0,0 +1,150 @@
+package transport
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lzh2nix/gb28181Simulator/internal/config"
+	"github.com/qiniu/x/xlog"
+)
+
+const tlsTestOptions = "OPTIONS sip:34020000001320000001@3402000000 SIP/2.0\r\n" +
+	"Via: SIP/2.0/TLS 127.0.0.1:5061;branch=z9hG4bK-tls\r\n" +
+	"From: <sip:34020000002000000001@3402000000>;tag=1\r\n" +
+	"To: <sip:34020000001320000001@3402000000>\r\n" +
+	"Call-ID: tls-test\r\n" +
+	"CSeq: 1 OPTIONS\r\n" +
+	"Content-Length: 0\r\n\r\n"
+
+// selfSigned makes a self-signed certificate for sip.test and 127.0.0.1 and
+// writes it to a pem file in dir.
+func selfSigned(t *testing.T, dir, name string) (tls.Certificate, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{"sip.test"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, name+".pem")
+	if err := ioutil.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, file
+}
+
+// serveTLS accepts one connection and sends an OPTIONS once the handshake is
+// done.
+func serveTLS(t *testing.T, cert tls.Certificate) net.Listener {
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if err := conn.(*tls.Conn).Handshake(); err != nil {
+			return
+		}
+		conn.Write([]byte(tlsTestOptions))
+		// hold the connection until the client is done
+		conn.Read(make([]byte, 1))
+	}()
+	return ln
+}
+
+func TestTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sim-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cert, caFile := selfSigned(t, dir, "server")
+	_, otherCAFile := selfSigned(t, dir, "other")
+
+	tests := []struct {
+		name       string
+		caFile     string
+		serverName string
+		ok         bool
+	}{
+		{"chain only", caFile, "", true},
+		{"server name", caFile, "sip.test", true},
+		{"wrong server name", caFile, "other.test", false},
+		{"wrong ca", otherCAFile, "", false},
+		{"wrong ca with server name", otherCAFile, "sip.test", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ln := serveTLS(t, cert)
+			defer ln.Close()
+			cfg := &config.Config{TLSCAFile: tt.caFile, TLSServerName: tt.serverName}
+			tr, err := StartSip(xlog.New("tls-test"), ln.Addr().String(), "tls", cfg)
+			if !tt.ok {
+				if err == nil {
+					tr.Close()
+					t.Fatal("handshake succeeded, want a certificate error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("start tls: %v", err)
+			}
+			defer tr.Close()
+			if tr.Proto() != "TLS" {
+				t.Errorf("proto = %s, want TLS", tr.Proto())
+			}
+			select {
+			case m := <-tr.Recv:
+				if m.Method != "OPTIONS" || m.CallID != "tls-test" {
+					t.Errorf("got %s %s, want the OPTIONS sent by the server", m.Method, m.CallID)
+				}
+			case <-time.After(time.Second * 5):
+				t.Fatal("no message received over tls")
+			}
+		})
+	}
+}
+
+func TestTLSConfigBadCA(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sim-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "ca.pem")
+	if err := ioutil.WriteFile(file, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newTLSConfig(&config.Config{TLSCAFile: file}); err != ErrBadCABundle {
+		t.Fatalf("err = %v, want %v", err, ErrBadCABundle)
+	}
+}
@@ -1,76 +1,449 @@
 package transport
 
 import (
+	"errors"
+	"fmt"
 	"net"
-	"time"
+	"strings"
+	"sync"
 
 	"github.com/jart/gosip/sip"
 	"github.com/lzh2nix/gb28181Simulator/internal/config"
+	"github.com/lzh2nix/gb28181Simulator/internal/stats"
 	"github.com/qiniu/x/xlog"
 )
 
-const sipMaxPacketSize = 1500
+const (
+	// largest datagram we accept
+	sipMaxPacketSize = 65535
+	// requests bigger than this go over tcp when the path mtu is unknown
+	// (RFC 3261 §18.1.1)
+	sipMTUPacketSize = 1300
+)
+
+var ErrUnknownTransport = errors.New("unknown sip transport")
 
 type Transport struct {
-	Conn *net.UDPConn
 	Recv chan *sip.Msg
 	Send chan *sip.Msg
+
+	// "UDP", "TCP" or "TLS", used as the Via sent-protocol
+	proto string
+
+	mu    sync.Mutex
+	conn  net.Conn
+	laddr net.Addr
+	// configured public signalling ip, see ContactAddr
+	advertisedIP string
+	// our address as seen by the registrar, from received/rport
+	publicIP   string
+	publicPort int
+	// where requests go on the unconnected udp socket
+	remote *net.UDPAddr
+	// peers allowed to send us requests, nil means any
+	allowed []*net.IPNet
+	// tcp connections opened for requests too large for udp, by peer
+	largeConns map[string]*largeConn
+	// closed and replaced whenever a stream connection is reestablished
+	reconnected chan struct{}
+
+	txMu      sync.Mutex
+	clientTxs map[string]*clientTx
+	serverTxs map[string]*serverTx
+	// INVITE server transactions by Call-ID and CSeq, to match the ACK of a 2xx
+	inviteTxs map[string]*serverTx
+
+	// the Pool whose devices share the socket, nil for a device of its own
+	router router
+	// the shared socket of a Pool endpoint, nil for a socket
+	sock *Transport
+
+	// closed by Close, stops the goroutines of the transport
+	done      chan struct{}
+	closeOnce sync.Once
+	// closed once the send loop flushed Send and returned
+	sent chan struct{}
+	// receive loops and the readers of large request connections
+	wg sync.WaitGroup
+}
+
+// router hands the messages of a shared socket to the devices of a Pool.
+type router interface {
+	// route delivers an incoming message instead of Recv
+	route(xlog *xlog.Logger, m *sip.Msg)
+	// sent sees every message before it is written
+	sent(m *sip.Msg)
+}
+
+func newTransport(proto string, cfg *config.Config, r router) *Transport {
+	return &Transport{
+		Recv:         make(chan *sip.Msg),
+		Send:         make(chan *sip.Msg, 1000),
+		proto:        proto,
+		advertisedIP: cfg.AdvertisedIP,
+		largeConns:   make(map[string]*largeConn),
+		reconnected:  make(chan struct{}),
+		clientTxs:    make(map[string]*clientTx),
+		serverTxs:    make(map[string]*serverTx),
+		inviteTxs:    make(map[string]*serverTx),
+		router:       r,
+		done:         make(chan struct{}),
+		sent:         make(chan struct{}),
+	}
 }
 
 func StartSip(xlog *xlog.Logger, remoteAddr string, transport string, cfg *config.Config) (*Transport, error) {
+	return startSip(xlog, remoteAddr, transport, cfg, nil)
+}
+
+func startSip(xlog *xlog.Logger, remoteAddr string, transport string, cfg *config.Config, r router) (*Transport, error) {
+	switch strings.ToLower(transport) {
+	case "", "udp":
+		return startUDP(xlog, remoteAddr, cfg, r)
+	case "tcp":
+		return startStream(xlog, "TCP", cfg, func() (net.Conn, error) {
+			return dialTCP(xlog, remoteAddr, cfg.LocalSipPort)
+		}, r)
+	case "tls":
+		tc, err := newTLSConfig(cfg)
+		if err != nil {
+			return nil, err
+		}
+		return startStream(xlog, "TLS", cfg, func() (net.Conn, error) {
+			conn, err := dialTCP(xlog, remoteAddr, cfg.LocalSipPort)
+			if err != nil {
+				return nil, err
+			}
+			return handshakeTLS(conn, tc)
+		}, r)
+	}
+	return nil, ErrUnknownTransport
+}
+
+// startUDP listens on the configured local port without connecting the
+// socket, so that requests from signalling nodes other than the registrar
+// reach us too.
+func startUDP(xlog *xlog.Logger, remoteAddr string, cfg *config.Config, r router) (*Transport, error) {
 	rAddr, err := net.ResolveUDPAddr("udp", remoteAddr)
 	if err != nil {
 		return nil, err
 	}
-	net, err := net.DialUDP(transport, nil, rAddr)
+	allowed, err := parsePeers(cfg.AllowedPeers)
+	if err != nil {
+		return nil, err
+	}
+	lIP, err := outboundIP(rAddr)
 	if err != nil {
-		xlog.Errorf("err = %#v", err.Error())
 		return nil, err
 	}
-	recvChan := make(chan *sip.Msg)
-	sendChan := make(chan *sip.Msg, 1000)
-	go send(xlog, net, sendChan, cfg)
-	go recv(xlog, net, recvChan, cfg)
-	tr := &Transport{
-		Conn: net,
-		Recv: recvChan,
-		Send: sendChan,
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: cfg.LocalSipPort})
+	if err != nil {
+		xlog.Errorf("listen udp port %d failed, err = %v", cfg.LocalSipPort, err)
+		return nil, err
 	}
+	tr := newTransport("UDP", cfg, r)
+	tr.remote = rAddr
+	tr.allowed = allowed
+	tr.setConn(conn)
+	tr.laddr = &net.UDPAddr{IP: lIP, Port: conn.LocalAddr().(*net.UDPAddr).Port}
+	go tr.send(xlog, cfg)
+	tr.wg.Add(1)
+	go tr.recv(xlog, conn, cfg)
 
 	return tr, nil
 }
 
-func recv(xlog *xlog.Logger, conn *net.UDPConn, output chan *sip.Msg, cfg *config.Config) {
+// Close flushes Send, closes the connections and returns once the goroutines
+// of the transport have exited. A Pool endpoint leaves its socket to
+// Pool.Close.
+func (tr *Transport) Close() {
+	if tr.sock != nil {
+		return
+	}
+	tr.closeOnce.Do(func() {
+		close(tr.done)
+		<-tr.sent
+		tr.stopTxs()
+		tr.mu.Lock()
+		if tr.conn != nil {
+			tr.conn.Close()
+		}
+		for key, lc := range tr.largeConns {
+			if lc.conn != nil {
+				lc.conn.Close()
+			}
+			delete(tr.largeConns, key)
+		}
+		tr.mu.Unlock()
+		tr.wg.Wait()
+	})
+}
+
+func (tr *Transport) closed() bool {
+	select {
+	case <-tr.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// stopTxs stops the timers of all transactions, no retransmission or timeout
+// may fire once the connection is gone.
+func (tr *Transport) stopTxs() {
+	tr.txMu.Lock()
+	defer tr.txMu.Unlock()
+	for key, tx := range tr.clientTxs {
+		tx.state = txTerminated
+		tx.stop()
+		delete(tr.clientTxs, key)
+	}
+	for key, tx := range tr.serverTxs {
+		tx.state = txTerminated
+		if tx.retrans != nil {
+			tx.retrans.Stop()
+		}
+		tx.timeout.Stop()
+		delete(tr.serverTxs, key)
+	}
+	tr.inviteTxs = make(map[string]*serverTx)
+}
+
+// Proto returns the transport token to put in our Via headers.
+func (tr *Transport) Proto() string {
+	return tr.socket().proto
+}
+
+// socket returns the transport owning the connection, tr itself unless it is
+// a Pool endpoint.
+func (tr *Transport) socket() *Transport {
+	if tr.sock != nil {
+		return tr.sock
+	}
+	return tr
+}
+
+func (tr *Transport) reliable() bool {
+	return tr.proto != "UDP"
+}
+
+// LocalAddr returns the host and port of the current signalling connection,
+// use ContactAddr for what to put in headers.
+func (tr *Transport) LocalAddr() (string, int) {
+	s := tr.socket()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch a := s.laddr.(type) {
+	case *net.UDPAddr:
+		return a.IP.String(), a.Port
+	case *net.TCPAddr:
+		return a.IP.String(), a.Port
+	}
+	return "", 0
+}
+
+func (tr *Transport) setConn(conn net.Conn) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	tr.conn = conn
+	if conn != nil {
+		tr.laddr = conn.LocalAddr()
+	}
+}
+
+// Reconnected returns a channel closed once the tcp or tls connection has
+// been reestablished, the platform's binding still points at the lost one
+// then. Call it again for the next reconnect; it is never closed for udp.
+func (tr *Transport) Reconnected() <-chan struct{} {
+	s := tr.socket()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.reconnected
+}
+
+func (tr *Transport) notifyReconnect() {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	close(tr.reconnected)
+	tr.reconnected = make(chan struct{})
+}
+
+func (tr *Transport) currentConn() net.Conn {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	return tr.conn
+}
 
+func (tr *Transport) recv(xlog *xlog.Logger, conn *net.UDPConn, cfg *config.Config) {
+	defer tr.wg.Done()
+	buf := make([]byte, sipMaxPacketSize)
 	for {
-		buf := make([]byte, sipMaxPacketSize)
-		conn.SetReadDeadline(time.Now().Add(time.Second * 5))
-		n, err := conn.Read(buf)
-		if n == 0 || err != nil {
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if tr.closed() {
+				return
+			}
+			xlog.Errorf("read udp failed, err = %v", err)
+			stats.TransportError("read")
+			continue
+		}
+		if n == 0 {
+			continue
+		}
+		if !tr.allow(addr) {
+			xlog.Infof("drop msg from %s, not in allowedPeers", addr)
 			continue
 		}
-		msg, err := sip.ParseMsg(buf[:n])
+		// a body other than sdp keeps pointing into what was parsed, so the
+		// parser gets a copy of the datagram rather than buf itself
+		msg, err := sip.ParseMsg(append([]byte(nil), buf[:n]...))
 		if err != nil {
 			xlog.Errorf("parse msg failed, err =%v", err)
+			stats.TransportError("parse")
 			continue
 		}
-		if cfg.DetailLog {
-			xlog.Debug("recv msg \n", msg)
+		msg.SourceAddr = addr
+		tr.deliver(xlog, msg, cfg)
+	}
+}
+
+func (tr *Transport) allow(addr *net.UDPAddr) bool {
+	if tr.allowed == nil || addr.IP.Equal(tr.remote.IP) {
+		return true
+	}
+	for _, n := range tr.allowed {
+		if n.Contains(addr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// parsePeers accepts plain ips as well as cidr blocks.
+func parsePeers(peers []string) ([]*net.IPNet, error) {
+	if len(peers) == 0 {
+		return nil, nil
+	}
+	nets := make([]*net.IPNet, 0, len(peers))
+	for _, p := range peers {
+		if !strings.Contains(p, "/") {
+			ip := net.ParseIP(p)
+			if ip == nil {
+				return nil, fmt.Errorf("bad allowedPeers entry %q", p)
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, err
 		}
-		output <- msg
+		nets = append(nets, n)
 	}
+	return nets, nil
 }
 
-func send(xlog *xlog.Logger, conn *net.UDPConn, input chan *sip.Msg, cfg *config.Config) {
+// outboundIP returns the local ip the kernel picks to reach the server; an
+// unconnected socket bound to the wildcard address can't tell us.
+func outboundIP(raddr *net.UDPAddr) (net.IP, error) {
+	conn, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
+
+// deliver hands an incoming message to the user agent unless the
+// transaction layer absorbs it.
+func (tr *Transport) deliver(xlog *xlog.Logger, msg *sip.Msg, cfg *config.Config) {
+	if cfg.DetailLog {
+		xlog.Debug("recv msg \n", msg)
+	}
+	stats.SIPMessage("in", msg)
+	if msg.IsResponse() && tr.handleClientResponse(xlog, msg) {
+		return
+	}
+	if !msg.IsResponse() && tr.handleServerRequest(xlog, msg) {
+		return
+	}
+	tr.dispatch(xlog, msg)
+}
+
+func (tr *Transport) dispatch(xlog *xlog.Logger, msg *sip.Msg) {
+	if tr.router != nil {
+		tr.router.route(xlog, msg)
+		return
+	}
+	select {
+	case tr.Recv <- msg:
+	case <-tr.done:
+	}
+}
 
-	for m := range input {
-		if cfg.DetailLog {
-			xlog.Debug("send msg \n", m)
+func (tr *Transport) send(xlog *xlog.Logger, cfg *config.Config) {
+	defer close(tr.sent)
+	for {
+		select {
+		case m := <-tr.Send:
+			tr.sendMsg(xlog, m, cfg)
+		case <-tr.done:
+			// what was queued before Close still goes out, e.g. the
+			// unregister and the BYEs of a shutdown
+			for {
+				select {
+				case m := <-tr.Send:
+					tr.sendMsg(xlog, m, cfg)
+				default:
+					return
+				}
+			}
 		}
-		//log.Printf("send addr: %p msg type: %s", m, m.Method)
-		if _, err := conn.Write([]byte(m.String())); err != nil {
-			xlog.Errorf("send msg failed, err = #v", err)
+	}
+}
+
+func (tr *Transport) sendMsg(xlog *xlog.Logger, m *sip.Msg, cfg *config.Config) {
+	if cfg.DetailLog {
+		xlog.Debug("send msg \n", m)
+	}
+	stats.SIPMessage("out", m)
+	if tr.router != nil {
+		tr.router.sent(m)
+	}
+	data := []byte(m.String())
+	var dst *net.UDPAddr
+	if !m.IsResponse() {
+		if !tr.reliable() && len(data) > sipMTUPacketSize && tr.sendLarge(xlog, m, cfg) {
+			return
 		}
+		tr.startClientTx(xlog, m, data, tr.reliable())
+	} else {
+		dst = tr.handleServerResponse(xlog, m, data)
 	}
+	//log.Printf("send addr: %p msg type: %s", m, m.Method)
+	tr.write(xlog, data, dst)
+}
 
+// write sends data to dst, or to the server when dst is nil. Stream
+// transports have a single connection and ignore dst.
+func (tr *Transport) write(xlog *xlog.Logger, data []byte, dst *net.UDPAddr) {
+	conn := tr.currentConn()
+	if conn == nil {
+		xlog.Errorf("no connection, drop %d bytes", len(data))
+		stats.TransportError("write")
+		return
+	}
+	var err error
+	if pc, ok := conn.(*net.UDPConn); ok {
+		if dst == nil {
+			dst = tr.remote
+		}
+		_, err = pc.WriteToUDP(data, dst)
+	} else {
+		_, err = conn.Write(data)
+	}
+	if err != nil && !tr.closed() {
+		xlog.Errorf("send msg failed, err = %v", err)
+		stats.TransportError("write")
+	}
 }
@@ -0,0 +1,39 @@
+package transport
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jart/gosip/sip"
+)
+
+// The bodies of datagrams received one after the other stay intact although
+// they are read into the same buffer.
+func TestRecvKeepsBodies(t *testing.T) {
+	tr, p := newPair(t)
+	defer p.close()
+	defer tr.Close()
+
+	bodies := []string{"<Query>first</Query>", "<Query>2nd</Query>"}
+	for i, body := range bodies {
+		msg := request("MESSAGE", "r"+strconv.Itoa(i), "z9hG4bK-r"+strconv.Itoa(i), 1)
+		msg = strings.Replace(msg, "Content-Length: 0\r\n\r\n",
+			"Content-Type: Application/MANSCDP+xml\r\nContent-Length: "+strconv.Itoa(len(body))+"\r\n\r\n"+body, 1)
+		p.send(msg)
+	}
+	var msgs []*sip.Msg
+	for range bodies {
+		m := recvMsg(tr, time.Second)
+		if m == nil || m.Payload == nil {
+			t.Fatalf("got %v, want a MESSAGE with a body", m)
+		}
+		msgs = append(msgs, m)
+	}
+	for i, body := range bodies {
+		if got := string(msgs[i].Payload.Data()); got != body {
+			t.Errorf("body %d = %q, want %q", i, got, body)
+		}
+	}
+}
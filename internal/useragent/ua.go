@@ -1,6 +1,7 @@
 package useragent
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
@@ -11,10 +12,12 @@ import (
 	"time"
 
 	"github.com/jart/gosip/sip"
+	"github.com/lzh2nix/gb28181Simulator/internal/alarm"
 	"github.com/lzh2nix/gb28181Simulator/internal/catalog"
 	"github.com/lzh2nix/gb28181Simulator/internal/config"
 	"github.com/lzh2nix/gb28181Simulator/internal/invite"
 	"github.com/lzh2nix/gb28181Simulator/internal/reg"
+	"github.com/lzh2nix/gb28181Simulator/internal/stats"
 	"github.com/lzh2nix/gb28181Simulator/internal/transport"
 	"github.com/qiniu/x/xlog"
 )
@@ -27,32 +30,85 @@ const (
 
 var msgTypeRegexp = regexp.MustCompile(`<CmdType>([\w]+)</CmdType>`)
 
+// how long Serve waits for the unregister to be answered once its context is
+// done
+const stopTimeout = time.Second * 5
+
 type Service struct {
+	cfg  *config.Config
 	tr   *transport.Transport
 	xlog *xlog.Logger
 
 	regSrv     *reg.Registar
 	catalogSrv *catalog.Catalog
 	inviteSrv  *invite.Invite
+	onEvent    func(Event)
+
+	// Close hands its context to Serve, which shuts down and closes done
+	quit chan context.Context
+	done chan struct{}
+}
+
+// Event is a message that reached the device after the transaction layer:
+// a request from the platform, a response to one of our requests, or the 408
+// of a request that timed out. An INVITE 408 is a 200 OK of the device that
+// the platform never acknowledged.
+type Event struct {
+	// request method, or CSeq method of a response
+	Method string
+	// 0 for requests
+	Status int
+	// CmdType of a MANSCDP body
+	CmdType string
+	CallID  string
+	// Request-URI user of a request, the channel of an INVITE
+	Target string
+	Msg    *sip.Msg
+}
+
+func newEvent(m *sip.Msg) Event {
+	e := Event{Method: m.Method, Status: m.Status, CallID: m.CallID, Msg: m}
+	if m.IsResponse() {
+		e.Method = m.CSeqMethod
+	} else if m.Request != nil {
+		e.Target = m.Request.User
+	}
+	if m.Payload != nil {
+		if t := msgType(m); t != Unknow {
+			e.CmdType = t
+		}
+	}
+	return e
 }
 
 func NewService(xlog *xlog.Logger, cfg *config.Config) (*Service, error) {
+	if err := invite.CheckMedia(cfg); err != nil {
+		return nil, err
+	}
 	tr, err := transport.StartSip(xlog, cfg.ServerAddr, cfg.Transport, cfg)
 	if err != nil {
 		return nil, err
 	}
+	return NewServiceWithTransport(xlog, cfg, tr), nil
+}
+
+// NewServiceWithTransport runs a device on an existing transport, e.g. an
+// endpoint of a transport.Pool.
+func NewServiceWithTransport(xlog *xlog.Logger, cfg *config.Config, tr *transport.Transport) *Service {
 	reg, _ := reg.NewRegistar(cfg)
 	catalog := catalog.NewCatalog(cfg)
-	invite := invite.NewInvite(cfg)
-	go reg.Run(xlog, tr)
+	invite := invite.NewInvite(cfg, catalog.Channels)
 	srv := &Service{
+		cfg:        cfg,
 		tr:         tr,
 		xlog:       xlog,
 		regSrv:     reg,
 		catalogSrv: catalog,
 		inviteSrv:  invite,
+		quit:       make(chan context.Context, 1),
+		done:       make(chan struct{}),
 	}
-	return srv, nil
+	return srv
 }
 func msgType(m *sip.Msg) string {
 	if len(m.Payload.Data()) != 0 && m.Payload.ContentType() == "Application/MANSCDP+xml" {
@@ -62,53 +118,230 @@ func msgType(m *sip.Msg) string {
 	}
 	return Unknow
 }
+
+// HandleIncommingMsg serves until SIGINT or SIGTERM, then shuts down and
+// prints the metrics report.
 func (s *Service) HandleIncommingMsg() {
-	s.hookSignals()
-	for m := range s.tr.Recv {
+	ctx, cancel := context.WithCancel(context.Background())
+	s.hookSignals(cancel)
+	s.Serve(ctx)
+	if err := stats.Dump(os.Stdout, s.cfg.ReportFile); err != nil {
+		s.xlog.Errorf("write report failed, err = %v", err)
+	}
+}
 
-		if m.IsResponse() && s.regSrv.HandleResponse(s.xlog, s.tr, m) {
-			continue
+// OnEvent sets a callback run for every incoming message before it is
+// handled, call it before Serve. fn must not block.
+func (s *Service) OnEvent(fn func(Event)) {
+	s.onEvent = fn
+}
+
+// SetAutoRegister turns registration on start and the periodic refresh on or
+// off, call it before Serve. Register and Unregister work either way.
+func (s *Service) SetAutoRegister(on bool) {
+	s.regSrv.SetAutoRegister(on)
+}
+
+// Serve starts registering and handles incoming messages without hooking os
+// signals, for callers that run many services in one process. When ctx is
+// done or Close is called it hangs up the active session, unregisters and
+// returns once every goroutine of the device has exited.
+func (s *Service) Serve(ctx context.Context) {
+	s.regSrv.Start(s.tr)
+	reconnected := s.tr.Reconnected()
+	var stopCtx context.Context
+	for stopCtx == nil {
+		select {
+		case m := <-s.tr.Recv:
+			s.handle(m)
+		case <-s.regSrv.Timer():
+			s.regSrv.Tick(s.tr)
+		case <-reconnected:
+			reconnected = s.tr.Reconnected()
+			s.regSrv.Reconnected(s.tr)
+		case register := <-s.regSrv.RegisterChan:
+			s.regSrv.SetRegister(s.tr, register)
+		case stopCtx = <-s.quit:
+		case <-ctx.Done():
+			c, cancelStop := context.WithTimeout(context.Background(), stopTimeout)
+			defer cancelStop()
+			stopCtx = c
 		}
-		if !m.IsResponse() && m.CSeqMethod == sip.MethodMessage {
-			switch msgType(m) {
-			case CataLog:
-				log.Println("got Catalog req")
-				s.catalogSrv.Handle(s.xlog, s.tr, m)
-			case Unknow:
-				fmt.Println("unknow msg, msg = ", m)
-			}
+	}
+	s.regSrv.Stop()
+	s.shutdown(stopCtx)
+}
+
+func (s *Service) handle(m *sip.Msg) {
+	if s.onEvent != nil {
+		s.onEvent(newEvent(m))
+	}
+
+	if m.IsResponse() && s.regSrv.HandleResponse(s.xlog, s.tr, m) {
+		return
+	}
+	if m.IsResponse() && m.Status == 408 {
+		s.xlog.Errorf("%s request timeout, callId:%s", m.CSeqMethod, m.CallID)
+		// the device sends no INVITE, this one is the platform's 2xx
+		// that was never acknowledged
+		if m.CSeqMethod != sip.MethodInvite {
+			return
+		}
+	}
+	if !m.IsResponse() && m.CSeqMethod == sip.MethodMessage {
+		switch msgType(m) {
+		case CataLog:
+			log.Println("got Catalog req")
+			s.catalogSrv.Handle(s.xlog, s.tr, m)
+		case Unknow:
+			fmt.Println("unknow msg, msg = ", m)
 		}
+	}
+
+	if m.CSeqMethod == sip.MethodInvite || m.CSeqMethod == sip.MethodBye || m.CSeqMethod == sip.MethodAck {
+		s.inviteSrv.HandleMsg(s.xlog, s.tr, m)
+	}
+}
 
-		if m.CSeqMethod == sip.MethodInvite || m.CSeqMethod == sip.MethodBye || m.CSeqMethod == sip.MethodAck {
-			s.inviteSrv.HandleMsg(s.xlog, s.tr, m)
+// shutdown runs once the registration timers are stopped. New requests are no longer
+// handled, only responses until the unregister is answered or ctx is done.
+func (s *Service) shutdown(ctx context.Context) {
+	defer close(s.done)
+	s.inviteSrv.Close(s.xlog, s.tr)
+	if unregistered := s.regSrv.Unregister(s.tr); unregistered != nil {
+	wait:
+		for {
+			select {
+			case m := <-s.tr.Recv:
+				if s.onEvent != nil {
+					s.onEvent(newEvent(m))
+				}
+				if m.IsResponse() {
+					s.regSrv.HandleResponse(s.xlog, s.tr, m)
+				}
+			case <-unregistered:
+				break wait
+			case <-ctx.Done():
+				s.xlog.Errorf("unregister not answered, err = %v", ctx.Err())
+				break wait
+			}
 		}
 	}
+	s.tr.Close()
+}
+
+// Close stops Serve, ctx bounds the wait for the unregister to be answered.
+// It returns ctx's error if Serve didn't finish in time.
+func (s *Service) Close(ctx context.Context) error {
+	select {
+	case s.quit <- ctx:
+	default:
+		// already closing
+	}
+	select {
+	case <-s.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// DeviceStatus is what the control api reports about a device.
+type DeviceStatus struct {
+	ID         string               `json:"id"`
+	Registered bool                 `json:"registered"`
+	Channels   []ChannelStatus      `json:"channels"`
+	Sessions   []invite.SessionInfo `json:"sessions"`
+}
+
+type ChannelStatus struct {
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	Status string `json:"status"`
+}
+
+func (s *Service) ID() string {
+	return s.cfg.GBID
+}
+
+func (s *Service) Status() DeviceStatus {
+	st := DeviceStatus{
+		ID:         s.cfg.GBID,
+		Registered: s.regSrv.Registered(),
+		Channels:   []ChannelStatus{},
+		Sessions:   s.inviteSrv.Sessions(),
+	}
+	for _, d := range s.catalogSrv.Channels() {
+		st.Channels = append(st.Channels, ChannelStatus{ID: d.DeviceID, Name: d.Name, Status: d.Status})
+	}
+	if st.Sessions == nil {
+		st.Sessions = []invite.SessionInfo{}
+	}
+	return st
+}
+
+// Register sends a REGISTER now, and resumes registering after Unregister.
+func (s *Service) Register() {
+	select {
+	case s.regSrv.RegisterChan <- true:
+	case <-s.done:
+	}
+}
+
+// Unregister unregisters the device and keeps it unregistered until Register.
+func (s *Service) Unregister() {
+	select {
+	case s.regSrv.RegisterChan <- false:
+	case <-s.done:
+	}
+}
+
+func (s *Service) SetChannelStatus(chid string, online bool) error {
+	return s.catalogSrv.SetStatus(s.xlog, s.tr, chid, online)
+}
+
+func (s *Service) Alarm(a alarm.Alarm) {
+	alarm.Send(s.xlog, s.tr, s.cfg, a)
+}
+
+// Hangup sends a BYE for the session with the given Call-ID.
+func (s *Service) Hangup(callID string) error {
+	return s.inviteSrv.Hangup(s.xlog, s.tr, callID)
 }
 
-func (s *Service) Close() {
-	s.regSrv.CloseChan <- true
-	time.Sleep(time.Millisecond * 20)
+func (s *Service) SetMediaSource(chid, file string) error {
+	for _, d := range s.catalogSrv.Channels() {
+		if d.DeviceID == chid {
+			return s.inviteSrv.SetMediaSource(chid, file)
+		}
+	}
+	return catalog.ErrUnknownChannel
 }
 
 // OnSignal will be called when a OS-level signal is received.
-func (s *Service) onSignal(sig os.Signal) {
+func (s *Service) onSignal(sig os.Signal, stop func()) {
 	switch sig {
 	case syscall.SIGTERM:
 		fallthrough
 	case syscall.SIGINT:
 		s.xlog.Infof("received signal %s, exiting...", sig.String())
-		s.Close()
-		os.Exit(0)
+		stop()
+	case syscall.SIGUSR1:
+		stats.Dump(os.Stdout, "")
 	}
 }
 
-// OnSignal starts the signal processing and makes su
-func (s *Service) hookSignals() {
+// OnSignal starts the signal processing, SIGINT and SIGTERM call stop and a
+// second one kills the process.
+func (s *Service) hookSignals(stop func()) {
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR1)
 	go func() {
 		for sig := range c {
-			s.onSignal(sig)
+			if sig != syscall.SIGUSR1 {
+				signal.Reset(syscall.SIGINT, syscall.SIGTERM)
+			}
+			s.onSignal(sig, stop)
 		}
 	}()
 }
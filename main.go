@@ -2,11 +2,17 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"log"
+	"net/http"
 	"os"
 
 	cli "github.com/jawher/mow.cli"
+	"github.com/lzh2nix/gb28181Simulator/internal/api"
+	"github.com/lzh2nix/gb28181Simulator/internal/bench"
 	"github.com/lzh2nix/gb28181Simulator/internal/config"
+	"github.com/lzh2nix/gb28181Simulator/internal/scenario"
+	"github.com/lzh2nix/gb28181Simulator/internal/stats"
 	"github.com/lzh2nix/gb28181Simulator/internal/useragent"
 	"github.com/qiniu/x/xlog"
 )
@@ -23,28 +29,154 @@ func main() {
 	confPath := app.StringOpt("c config", "sim.conf", "Specifies the configuration path (file) to use for the simulator.")
 	detailLog := app.BoolOpt("v verbose", false, "Enables verbose logging.")
 	id := app.StringOpt("i id", "", "Specifies the device id to use for the simulator.")
-	app.Action = func() { run(xlog, app, confPath, *detailLog, *id) }
+	report := app.StringOpt("report", "", "Writes the metrics report to this .json or .csv file on exit.")
+	metricsAddr := app.StringOpt("metrics-addr", "", "Serves prometheus metrics on this address, e.g. :9100.")
+	apiAddr := app.StringOpt("api-addr", "", "Serves the control api on this address, e.g. 127.0.0.1:8080.")
+	app.Action = func() {
+		if !run(xlog, app, confPath, *detailLog, *id, *report, *metricsAddr, *apiAddr) {
+			cli.Exit(1)
+		}
+	}
 
 	// Register sub-commands
 	//app.Command("version", "Prints the version of the executable.", version.Print)
+	app.Command("bench", "Runs many simulated devices in one process.", func(cmd *cli.Cmd) {
+		count := cmd.IntOpt("n count", 0, "Overrides bench.deviceCount.")
+		rate := cmd.IntOpt("r rate", -1, "Overrides bench.rampUpRate (devices per second).")
+		cmd.Action = func() {
+			if !runBench(xlog, confPath, *detailLog, *report, *metricsAddr, *apiAddr, *count, *rate) {
+				cli.Exit(1)
+			}
+		}
+	})
+	app.Command("scenario", "Runs a scripted scenario and exits non-zero when a step fails.", func(cmd *cli.Cmd) {
+		cmd.Spec = "FILE"
+		file := cmd.StringArg("FILE", "", "Scenario file, .yaml/.yml or .json.")
+		cmd.Action = func() {
+			if !runScenario(xlog, confPath, *detailLog, *id, *file) {
+				cli.Exit(1)
+			}
+		}
+	})
 	app.Run(os.Args)
 }
 
-func run(xlog *xlog.Logger, app *cli.Cli, conf *string, detailLog bool, id string) {
+func runScenario(xlog *xlog.Logger, conf *string, detailLog bool, id, file string) bool {
+	cfg, err := config.ParseJsonConfig(conf)
+	if err != nil {
+		xlog.Errorf("load config file failed, err = %v", err)
+		return false
+	}
+	cfg.DetailLog = detailLog
+	if id != "" {
+		cfg.GBID = id
+	}
+	sc, err := scenario.Load(file)
+	if err != nil {
+		xlog.Errorf("load scenario failed, err = %v", err)
+		return false
+	}
+	results, err := scenario.Run(xlog, cfg, sc)
+	fmt.Printf("=== scenario %s ===\n", sc.Name)
+	for _, r := range results {
+		status := "PASS"
+		if r.Err != nil {
+			status = "FAIL " + r.Err.Error()
+		}
+		fmt.Printf("%3d %-40s %8.3fs %s\n", r.Step, r.Name, r.Elapsed.Seconds(), status)
+	}
+	if err != nil {
+		fmt.Println("FAIL:", err)
+		return false
+	}
+	fmt.Println("PASS")
+	return true
+}
+
+// serveMetrics starts the /metrics endpoint when an address is configured.
+func serveMetrics(xlog *xlog.Logger, cfg *config.Config) {
+	if cfg.MetricsAddr == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", stats.Handler())
+	go func() {
+		xlog.Infof("serve metrics on %s/metrics", cfg.MetricsAddr)
+		if err := http.ListenAndServe(cfg.MetricsAddr, mux); err != nil {
+			xlog.Errorf("serve metrics failed, err = %v", err)
+		}
+	}()
+}
+
+func runBench(xlog *xlog.Logger, conf *string, detailLog bool, report, metricsAddr, apiAddr string, count, rate int) bool {
+	cfg, err := config.ParseJsonConfig(conf)
+	if err != nil {
+		xlog.Errorf("load config file failed, err = %v", err)
+		return false
+	}
+	cfg.DetailLog = detailLog
+	if report != "" {
+		cfg.ReportFile = report
+	}
+	if metricsAddr != "" {
+		cfg.MetricsAddr = metricsAddr
+	}
+	if apiAddr != "" {
+		cfg.APIAddr = apiAddr
+	}
+	if count > 0 {
+		cfg.Bench.DeviceCount = count
+	}
+	if rate >= 0 {
+		cfg.Bench.RampUpRate = rate
+	}
+	r, err := bench.NewRunner(xlog, cfg)
+	if err != nil {
+		xlog.Errorf("new bench runner failed, err = %v", err)
+		return false
+	}
+	serveMetrics(xlog, cfg)
+	if cfg.APIAddr != "" {
+		a := api.NewServer(xlog)
+		a.ListenAndServe(cfg.APIAddr)
+		r.OnStart = func(srv *useragent.Service) { a.Add(srv) }
+	}
+	r.Run()
+	return true
+}
+
+func run(xlog *xlog.Logger, app *cli.Cli, conf *string, detailLog bool, id, report, metricsAddr, apiAddr string) bool {
 	xlog.Infof("gb28181 simulator is running...")
 	cfg, err := config.ParseJsonConfig(conf)
 	if err != nil {
-		xlog.Errorf("load config file failed, err = ", err)
+		xlog.Errorf("load config file failed, err = %v", err)
+		return false
 	}
 	cfg.DetailLog = detailLog
 	if id != "" {
 		cfg.GBID = id
 	}
+	if report != "" {
+		cfg.ReportFile = report
+	}
+	if metricsAddr != "" {
+		cfg.MetricsAddr = metricsAddr
+	}
+	if apiAddr != "" {
+		cfg.APIAddr = apiAddr
+	}
 	//xlog.Infof("config file = %#v", cfg)
 	srv, err := useragent.NewService(xlog, cfg)
 	if err != nil {
-		xlog.Infof("new service failed err = %#v", err)
-		return
+		xlog.Errorf("new service failed, err = %v", err)
+		return false
+	}
+	serveMetrics(xlog, cfg)
+	if cfg.APIAddr != "" {
+		a := api.NewServer(xlog)
+		a.Add(srv)
+		a.ListenAndServe(cfg.APIAddr)
 	}
 	srv.HandleIncommingMsg()
+	return true
 }
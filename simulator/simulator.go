@@ -0,0 +1,262 @@
+// Package simulator runs simulated GB28181 devices inside another Go program,
+// typically an integration test of a platform:
+//
+//	dev, err := simulator.New(&simulator.Config{...}, simulator.Handlers{
+//		Invite: func(e simulator.Event) { invites <- e },
+//	})
+//	if err := dev.Start(ctx); err != nil { ... }
+//	defer dev.Stop(ctx)
+//	if err := dev.WaitRegistered(ctx); err != nil { ... }
+package simulator
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/jart/gosip/sip"
+	"github.com/lzh2nix/gb28181Simulator/internal/alarm"
+	"github.com/lzh2nix/gb28181Simulator/internal/config"
+	"github.com/lzh2nix/gb28181Simulator/internal/useragent"
+	"github.com/qiniu/x/xlog"
+)
+
+type (
+	// Config is the same configuration the gb28181Simulator command reads
+	// from its json file.
+	Config     = config.Config
+	DeviceInfo = config.DeviceInfo
+	// Event is a message that reached the device.
+	Event = useragent.Event
+	// Status is a snapshot of the device, its channels and sessions.
+	Status = useragent.DeviceStatus
+	Alarm  = alarm.Alarm
+)
+
+var (
+	ErrNoID       = errors.New("simulator: config needs gbID")
+	ErrNoServer   = errors.New("simulator: config needs serverAddr")
+	ErrStarted    = errors.New("simulator: device already started")
+	ErrNotStarted = errors.New("simulator: device not started")
+)
+
+// how often WaitRegistered looks at the registration state
+const pollInterval = time.Millisecond * 20
+
+// Handlers are called from the device's message loop for what the platform
+// did. They must not block; hand the event to a channel to wait on it. Nil
+// handlers are skipped.
+type Handlers struct {
+	// a REGISTER, first or refresh, was accepted
+	Registered func(Event)
+	// a MESSAGE request from the platform, e.g. a Catalog or DeviceInfo query
+	Query  func(Event)
+	Invite func(Event)
+	// a BYE from the platform
+	Bye func(Event)
+	// every message, called before the ones above
+	Any func(Event)
+}
+
+// Device is one simulated device.
+type Device struct {
+	cfg  *Config
+	h    Handlers
+	xlog *xlog.Logger
+
+	mu  sync.Mutex
+	srv *useragent.Service
+	// registering is left to Register and Unregister
+	manual bool
+}
+
+// New checks cfg and fills in the defaults of sim.conf for unset timers. The
+// device works on a copy, cfg is left as it is and later changes to it don't
+// reach the device. The device doesn't touch the network until Start.
+func New(cfg *Config, h Handlers) (*Device, error) {
+	if cfg.GBID == "" {
+		return nil, ErrNoID
+	}
+	if cfg.ServerAddr == "" {
+		return nil, ErrNoServer
+	}
+	c := *cfg
+	// the channel status is kept in the devices
+	c.Devices = append([]DeviceInfo(nil), cfg.Devices...)
+	c.SetDefaults()
+	return &Device{cfg: &c, h: h, xlog: xlog.New(cfg.GBID)}, nil
+}
+
+// LoadConfig reads a json config file in the format of sim.conf.
+func LoadConfig(path string) (*Config, error) {
+	return config.ParseJsonConfig(&path)
+}
+
+// SetAutoRegister turns registration on start and the periodic refresh on or
+// off, call it before Start. It is on by default.
+func (d *Device) SetAutoRegister(on bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.manual = !on
+}
+
+// Start binds the local sip port and starts registering unless turned off
+// with SetAutoRegister. It doesn't wait for the platform, see WaitRegistered.
+func (d *Device) Start(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.srv != nil {
+		return ErrStarted
+	}
+	srv, err := useragent.NewService(d.xlog, d.cfg)
+	if err != nil {
+		return err
+	}
+	srv.OnEvent(d.dispatch)
+	srv.SetAutoRegister(!d.manual)
+	d.srv = srv
+	go srv.Serve(context.Background())
+	return nil
+}
+
+func (d *Device) dispatch(e Event) {
+	if d.h.Any != nil {
+		d.h.Any(e)
+	}
+	switch {
+	case e.Status == 0 && e.Method == sip.MethodMessage:
+		if d.h.Query != nil {
+			d.h.Query(e)
+		}
+	case e.Status == 0 && e.Method == sip.MethodInvite:
+		if d.h.Invite != nil {
+			d.h.Invite(e)
+		}
+	case e.Status == 0 && e.Method == sip.MethodBye:
+		if d.h.Bye != nil {
+			d.h.Bye(e)
+		}
+	case e.Method == sip.MethodRegister && e.Status == 200 && e.Msg.Expires != 0:
+		if d.h.Registered != nil {
+			d.h.Registered(e)
+		}
+	}
+}
+
+// Stop hangs up the active session, unregisters the device and waits for the
+// platform's response until ctx is done. Once it returned nil the port is
+// free and no goroutine of the device is left.
+func (d *Device) Stop(ctx context.Context) error {
+	d.mu.Lock()
+	srv := d.srv
+	d.srv = nil
+	d.mu.Unlock()
+	if srv == nil {
+		return ErrNotStarted
+	}
+	return srv.Close(ctx)
+}
+
+// WaitRegistered returns once the platform accepted a REGISTER, or ctx's error.
+func (d *Device) WaitRegistered(ctx context.Context) error {
+	t := time.NewTicker(pollInterval)
+	defer t.Stop()
+	for {
+		if d.Registered() {
+			return nil
+		}
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (d *Device) service() (*useragent.Service, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.srv == nil {
+		return nil, ErrNotStarted
+	}
+	return d.srv, nil
+}
+
+func (d *Device) ID() string {
+	return d.cfg.GBID
+}
+
+func (d *Device) Registered() bool {
+	srv, err := d.service()
+	return err == nil && srv.Status().Registered
+}
+
+// Status is the zero Status with the device id before Start.
+func (d *Device) Status() Status {
+	srv, err := d.service()
+	if err != nil {
+		return Status{ID: d.cfg.GBID}
+	}
+	return srv.Status()
+}
+
+// Register sends a REGISTER now, and resumes registering after Unregister.
+func (d *Device) Register() error {
+	srv, err := d.service()
+	if err != nil {
+		return err
+	}
+	srv.Register()
+	return nil
+}
+
+// Unregister unregisters the device and keeps it unregistered until Register.
+func (d *Device) Unregister() error {
+	srv, err := d.service()
+	if err != nil {
+		return err
+	}
+	srv.Unregister()
+	return nil
+}
+
+// SetChannelStatus marks a channel ON or OFF and notifies the platform.
+func (d *Device) SetChannelStatus(chid string, online bool) error {
+	srv, err := d.service()
+	if err != nil {
+		return err
+	}
+	return srv.SetChannelStatus(chid, online)
+}
+
+// Alarm sends an alarm notify, for the device itself when a.DeviceID is empty.
+func (d *Device) Alarm(a Alarm) error {
+	srv, err := d.service()
+	if err != nil {
+		return err
+	}
+	srv.Alarm(a)
+	return nil
+}
+
+// Hangup sends a BYE for the session with the given Call-ID.
+func (d *Device) Hangup(callID string) error {
+	srv, err := d.service()
+	if err != nil {
+		return err
+	}
+	return srv.Hangup(callID)
+}
+
+// SetMediaSource changes the file streamed for a channel's next session.
+func (d *Device) SetMediaSource(chid, file string) error {
+	srv, err := d.service()
+	if err != nil {
+		return err
+	}
+	return srv.SetMediaSource(chid, file)
+}
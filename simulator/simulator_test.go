@@ -0,0 +1,190 @@
+package simulator_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lzh2nix/gb28181Simulator/simulator"
+)
+
+// startRegistrar runs a platform on a local udp port that challenges a
+// REGISTER without credentials and accepts every other request.
+func startRegistrar() (addr string, stop func()) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		panic(err)
+	}
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, peer, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if req := string(buf[:n]); !strings.HasPrefix(req, "SIP/2.0") {
+				conn.WriteToUDP([]byte(answer(req)), peer)
+			}
+		}
+	}()
+	return conn.LocalAddr().String(), func() { conn.Close() }
+}
+
+func answer(req string) string {
+	status, auth := "200 OK", ""
+	if strings.HasPrefix(req, "REGISTER") && !strings.Contains(req, "\r\nAuthorization:") {
+		status = "401 Unauthorized"
+		auth = "WWW-Authenticate: Digest realm=\"3201150000\",nonce=\"simulator\",algorithm=MD5\r\n"
+	}
+	var b strings.Builder
+	b.WriteString("SIP/2.0 " + status + "\r\n")
+	head := strings.SplitN(req, "\r\n\r\n", 2)[0]
+	for _, line := range strings.Split(head, "\r\n")[1:] {
+		i := strings.IndexByte(line, ':')
+		if i < 0 {
+			continue
+		}
+		switch strings.ToLower(strings.TrimSpace(line[:i])) {
+		case "via", "v", "from", "f", "to", "t", "call-id", "i", "cseq", "expires":
+			b.WriteString(line + "\r\n")
+		}
+	}
+	b.WriteString(auth + "Content-Length: 0\r\n\r\n")
+	return b.String()
+}
+
+func testConfig(server string) *simulator.Config {
+	return &simulator.Config{
+		GBID:       "31011500991180000130",
+		ServerID:   "32011500002000000001",
+		Realm:      "3201150000",
+		ServerAddr: server,
+		UserName:   "test",
+		Password:   "test",
+	}
+}
+
+func Example() {
+	server, stop := startRegistrar()
+	defer stop()
+
+	dev, err := simulator.New(&simulator.Config{
+		GBID:       "31011500991180000130",
+		ServerID:   "32011500002000000001",
+		Realm:      "3201150000",
+		ServerAddr: server,
+		UserName:   "test",
+		Password:   "test",
+	}, simulator.Handlers{})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	if err := dev.Start(ctx); err != nil {
+		fmt.Println(err)
+		return
+	}
+	if err := dev.WaitRegistered(ctx); err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Println("registered:", dev.Registered())
+	if err := dev.Stop(ctx); err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Println("after stop:", dev.Registered())
+	// Output:
+	// registered: true
+	// after stop: false
+}
+
+func TestDevice(t *testing.T) {
+	server, stop := startRegistrar()
+	defer stop()
+	cfg := testConfig(server)
+	registered := make(chan simulator.Event, 10)
+	dev, err := simulator.New(cfg, simulator.Handlers{
+		Registered: func(e simulator.Event) { registered <- e },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.RegExpire != 0 || cfg.Transport != "" {
+		t.Errorf("New changed the caller's config: regExpire %d, transport %q", cfg.RegExpire, cfg.Transport)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	if err := dev.Stop(ctx); err != simulator.ErrNotStarted {
+		t.Errorf("Stop before Start = %v, want %v", err, simulator.ErrNotStarted)
+	}
+	if err := dev.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := dev.Start(ctx); err != simulator.ErrStarted {
+		t.Errorf("second Start = %v, want %v", err, simulator.ErrStarted)
+	}
+	if err := dev.WaitRegistered(ctx); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case e := <-registered:
+		if e.Status != 200 {
+			t.Errorf("Registered handler got %d, want 200", e.Status)
+		}
+	case <-ctx.Done():
+		t.Fatal("Registered handler not called")
+	}
+	if st := dev.Status(); st.ID != cfg.GBID || !st.Registered {
+		t.Errorf("status %+v, want registered %s", st, cfg.GBID)
+	}
+	if err := dev.Stop(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if dev.Registered() {
+		t.Error("registered after Stop")
+	}
+	if err := dev.Stop(ctx); err != simulator.ErrNotStarted {
+		t.Errorf("second Stop = %v, want %v", err, simulator.ErrNotStarted)
+	}
+}
+
+func TestNewNeedsIDAndServer(t *testing.T) {
+	if _, err := simulator.New(&simulator.Config{ServerAddr: "127.0.0.1:5060"}, simulator.Handlers{}); err != simulator.ErrNoID {
+		t.Errorf("err = %v, want %v", err, simulator.ErrNoID)
+	}
+	if _, err := simulator.New(&simulator.Config{GBID: "31011500991180000130"}, simulator.Handlers{}); err != simulator.ErrNoServer {
+		t.Errorf("err = %v, want %v", err, simulator.ErrNoServer)
+	}
+}
+
+func TestWaitRegisteredTimeout(t *testing.T) {
+	// nothing answers on the port
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	dev, err := simulator.New(testConfig(conn.LocalAddr().String()), simulator.Handlers{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dev.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*200)
+	defer cancel()
+	if err := dev.WaitRegistered(ctx); err != context.DeadlineExceeded {
+		t.Errorf("err = %v, want %v", err, context.DeadlineExceeded)
+	}
+	stopCtx, cancelStop := context.WithTimeout(context.Background(), time.Second)
+	defer cancelStop()
+	if err := dev.Stop(stopCtx); err != nil {
+		t.Fatal(err)
+	}
+}